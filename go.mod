@@ -0,0 +1,28 @@
+module github.com/yosisa/fluxion-out-prometheus
+
+go 1.25.0
+
+// github.com/yosisa/fluxion is required as well but is not listed yet: the
+// module proxy does not serve it ("This module version is not available"),
+// so its version and checksums could not be resolved here. Add it with
+//
+//	GOPROXY=direct go get github.com/yosisa/fluxion@latest
+//
+// which records the require and the go.sum lines.
+
+require (
+	github.com/BurntSushi/toml v1.6.0
+	github.com/prometheus/client_golang v1.24.1
+	github.com/prometheus/client_model v0.6.2
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/kylelemons/godebug v1.1.0 // indirect
+	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
+	github.com/prometheus/common v0.70.1 // indirect
+	github.com/prometheus/procfs v0.21.1 // indirect
+	golang.org/x/sys v0.47.0 // indirect
+	google.golang.org/protobuf v1.36.11 // indirect
+)
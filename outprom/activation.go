@@ -0,0 +1,86 @@
+package outprom
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const listenFdsStart = 3
+
+// inheritedSockets holds the sockets passed by systemd socket activation,
+// following the sd_listen_fds convention. The files are kept open for the
+// lifetime of the process; listeners are created from duplicates so that
+// closing them on Close leaves the sockets intact for the next Start.
+var inheritedSockets struct {
+	once  sync.Once
+	files []*os.File
+	names []string
+}
+
+func loadInheritedSockets() {
+	s := &inheritedSockets
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	// The plugin is usually spawned by fluxion, which is the process
+	// activated by systemd and has to pass the sockets on.
+	if err != nil || (pid != os.Getpid() && pid != os.Getppid()) {
+		return
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for i := 0; i < n; i++ {
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		s.files = append(s.files, os.NewFile(uintptr(listenFdsStart+i), "LISTEN_FD_"+strconv.Itoa(listenFdsStart+i)))
+		s.names = append(s.names, name)
+	}
+}
+
+// activated reports whether the process received sockets from systemd.
+func activated() bool {
+	inheritedSockets.once.Do(loadInheritedSockets)
+	return len(inheritedSockets.files) > 0
+}
+
+// inheritedListener returns a listener on the inherited socket selected by
+// spec, which is an index, a name given by FileDescriptorName= or empty for
+// the first socket.
+func inheritedListener(spec string) (net.Listener, error) {
+	if !activated() {
+		return nil, fmt.Errorf("No socket passed by systemd")
+	}
+	s := &inheritedSockets
+	idx := -1
+	if spec == "" {
+		idx = 0
+	} else if i, err := strconv.Atoi(spec); err == nil {
+		idx = i
+	} else {
+		for i, name := range s.names {
+			if name == spec {
+				idx = i
+				break
+			}
+		}
+	}
+	if idx < 0 || idx >= len(s.files) {
+		return nil, fmt.Errorf("No socket %q passed by systemd", spec)
+	}
+	ln, err := net.FileListener(s.files[idx])
+	if err != nil {
+		return nil, err
+	}
+	// Never remove the socket file owned by systemd.
+	if ul, ok := ln.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(false)
+	}
+	return ln, nil
+}
@@ -0,0 +1,121 @@
+package outprom
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func (m *Metric) labelNames() []string {
+	return m.labelKeys
+}
+
+// seriesHandler serves DELETE /-/series, which deletes the series of the
+// metric given by metric, either the config key or the exposed name, whose
+// labels match every label=<name>=<value> parameter.
+func (p *OutPrometheus) seriesHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			w.Header().Set("Allow", http.MethodDelete)
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		q := r.URL.Query()
+		name := q.Get("metric")
+		if name == "" {
+			http.Error(w, "metric is required", http.StatusBadRequest)
+			return
+		}
+		match := make(map[string]string)
+		for _, l := range q["label"] {
+			i := strings.Index(l, "=")
+			if i <= 0 {
+				http.Error(w, fmt.Sprintf("Invalid label: %s", l), http.StatusBadRequest)
+				return
+			}
+			match[l[:i]] = l[i+1:]
+		}
+		metrics := p.currentMetrics()
+		found, deleted := false, 0
+		for _, h := range p.loadHandlers() {
+			key := h.metricName()
+			m := metrics[key]
+			if key != name && m.fqName(key) != name {
+				continue
+			}
+			if _, ok := h.(*templatedMetric); ok {
+				http.Error(w, fmt.Sprintf("Deleting series of %s with name_template is not supported", name), http.StatusBadRequest)
+				return
+			}
+			found = true
+			deleted += deleteSeries(h, match)
+		}
+		if !found {
+			http.Error(w, fmt.Sprintf("Unknown metric: %s", name), http.StatusNotFound)
+			return
+		}
+		p.env.Log.Infof("Deleted %d series of %s matching %v", deleted, name, match)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"deleted": deleted})
+	})
+}
+
+// deleteSeries deletes the series of the handler whose labels match, returning
+// the number of series deleted.
+func deleteSeries(h Handler, match map[string]string) int {
+	keys := h.(interface{ labelNames() []string }).labelNames()
+	ch := make(chan prometheus.Metric)
+	go func() {
+		h.Collect(ch)
+		close(ch)
+	}()
+	seen := make(map[string]bool)
+	var targets [][]string
+	for m := range ch {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			continue
+		}
+		labels := make(map[string]string, len(pb.Label))
+		for _, lp := range pb.Label {
+			labels[lp.GetName()] = lp.GetValue()
+		}
+		if !matchLabels(labels, match) {
+			continue
+		}
+		lvals := make([]string, len(keys))
+		for i, key := range keys {
+			lvals[i] = labels[key]
+		}
+		if key := seriesKey(lvals); !seen[key] {
+			seen[key] = true
+			targets = append(targets, lvals)
+		}
+	}
+	n := 0
+	for _, lvals := range targets {
+		var ok bool
+		if e := h.expiry(); e != nil {
+			ok = e.remove(lvals)
+		} else {
+			ok = h.DeleteLabelValues(lvals...)
+		}
+		if ok {
+			n++
+		}
+	}
+	return n
+}
+
+func matchLabels(labels, match map[string]string) bool {
+	for k, v := range match {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,168 @@
+package outprom
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type Aggregation string
+
+func (a *Aggregation) UnmarshalText(b []byte) error {
+	s := string(b)
+	switch s {
+	case "last", "min", "max", "avg", "sum":
+		*a = Aggregation(s)
+		return nil
+	}
+	return fmt.Errorf("Unknown aggregation: %s", s)
+}
+
+// aggregateVec is a collector of gauges which export an aggregation of the
+// values observed within a window instead of the last value. Without a window
+// the observations are aggregated between scrapes, which assumes a single
+// Prometheus server scrapes the metric.
+type aggregateVec struct {
+	desc   *prometheus.Desc
+	agg    Aggregation
+	window time.Duration
+	mu     sync.Mutex
+	series map[string]*aggregateSeries
+}
+
+type aggregateSeries struct {
+	values []string
+	start  time.Time
+	cur    aggregateState
+	done   *aggregateState
+}
+
+type aggregateState struct {
+	count         int
+	sum, min, max float64
+}
+
+func (s *aggregateState) observe(v float64) {
+	if s.count == 0 || v < s.min {
+		s.min = v
+	}
+	if s.count == 0 || v > s.max {
+		s.max = v
+	}
+	s.count++
+	s.sum += v
+}
+
+func (s *aggregateState) value(agg Aggregation) float64 {
+	switch agg {
+	case "min":
+		return s.min
+	case "max":
+		return s.max
+	case "avg":
+		return s.sum / float64(s.count)
+	}
+	return s.sum
+}
+
+func newAggregateVec(name string, m *Metric) *aggregateVec {
+	return &aggregateVec{
+		desc:   m.newDesc(name, m.labelKeys),
+		agg:    m.Aggregate,
+		window: m.AggregateWindow.Duration,
+		series: make(map[string]*aggregateSeries),
+	}
+}
+
+func (a *aggregateVec) observe(lvals []string, v float64) {
+	key := seriesKey(lvals)
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s, ok := a.series[key]
+	if !ok {
+		s = &aggregateSeries{values: append([]string(nil), lvals...), start: now}
+		a.series[key] = s
+	}
+	a.roll(s, now)
+	s.cur.observe(v)
+}
+
+// roll completes the current window of the series if it has elapsed.
+func (a *aggregateVec) roll(s *aggregateSeries, now time.Time) {
+	if a.window == 0 || now.Sub(s.start) < a.window {
+		return
+	}
+	if s.cur.count > 0 {
+		done := s.cur
+		s.done = &done
+	}
+	s.cur = aggregateState{}
+	s.start = now
+}
+
+func (a *aggregateVec) Describe(ch chan<- *prometheus.Desc) {
+	ch <- a.desc
+}
+
+func (a *aggregateVec) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, s := range a.series {
+		state := s.done
+		if a.window == 0 {
+			if s.cur.count > 0 {
+				done := s.cur
+				s.done, state = &done, &done
+				s.cur = aggregateState{}
+			}
+		} else {
+			a.roll(s, now)
+			if state = s.done; state == nil && s.cur.count > 0 {
+				state = &s.cur
+			}
+		}
+		if state == nil {
+			continue
+		}
+		v := state.value(a.agg)
+		if math.IsNaN(v) {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(a.desc, prometheus.GaugeValue, v, s.values...)
+	}
+}
+
+func (a *aggregateVec) DeleteLabelValues(lvals ...string) bool {
+	key := seriesKey(lvals)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, ok := a.series[key]
+	delete(a.series, key)
+	return ok
+}
+
+// AggregateGauge is a gauge exporting an aggregation of the observed values.
+type AggregateGauge struct {
+	Metric
+	*aggregateVec
+}
+
+func newAggregateGauge(name string, m *Metric, reg prometheus.Registerer) (*AggregateGauge, error) {
+	v := newAggregateVec(name, m)
+	if err := reg.Register(v); err != nil {
+		return nil, err
+	}
+	return &AggregateGauge{Metric: *m, aggregateVec: v}, nil
+}
+
+func (g *AggregateGauge) HandleEvent(ev *event) error {
+	return g.each(ev, func(v float64, lvals []string) error {
+		g.observe(lvals, v)
+		return nil
+	})
+}
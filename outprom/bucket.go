@@ -0,0 +1,184 @@
+package outprom
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// bucketedVec is a collector of histograms whose buckets are counted upstream
+// and read from the records.
+type bucketedVec struct {
+	desc   *prometheus.Desc
+	mu     sync.Mutex
+	series map[string]*bucketedSeries
+}
+
+type bucketedSeries struct {
+	values  []string
+	buckets map[float64]uint64
+	count   uint64
+	sum     float64
+}
+
+func (b *bucketedVec) Describe(ch chan<- *prometheus.Desc) {
+	ch <- b.desc
+}
+
+func (b *bucketedVec) Collect(ch chan<- prometheus.Metric) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, s := range b.series {
+		ch <- prometheus.MustNewConstHistogram(b.desc, s.count, s.sum, s.buckets, s.values...)
+	}
+}
+
+func (b *bucketedVec) DeleteLabelValues(lvals ...string) bool {
+	key := seriesKey(lvals)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.series[key]
+	delete(b.series, key)
+	return ok
+}
+
+// BucketedHistogram is a histogram built from pre-aggregated bucket counts.
+// bucket_paths maps upper bounds, including "+Inf", to the paths of the
+// cumulative counts of the buckets. Each event either adds to the histogram
+// or replaces it, if bucket_update is "replace".
+type BucketedHistogram struct {
+	Metric
+	*bucketedVec
+	bounds []float64
+	paths  []string
+}
+
+func newBucketedHistogram(name string, m *Metric, reg prometheus.Registerer) (*BucketedHistogram, error) {
+	if !m.Value.isEmpty() || m.ValueExpr != "" {
+		return nil, fmt.Errorf("Histogram %s having bucket_paths cannot have a value", name)
+	}
+	switch m.BucketUpdate {
+	case "":
+		m.BucketUpdate = "add"
+	case "add", "replace":
+	default:
+		return nil, fmt.Errorf("Unknown bucket_update of %s: %s", name, m.BucketUpdate)
+	}
+	h := &BucketedHistogram{Metric: *m}
+	paths := make(map[float64]string, len(m.BucketPaths))
+	for s, p := range m.BucketPaths {
+		bound, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid bucket bound of %s: %s", name, s)
+		}
+		paths[bound] = p
+		h.bounds = append(h.bounds, bound)
+	}
+	sort.Float64s(h.bounds)
+	for _, bound := range h.bounds {
+		h.paths = append(h.paths, paths[bound])
+	}
+	if len(h.bounds) == 0 || !math.IsInf(h.bounds[len(h.bounds)-1], 1) && m.CountPath == "" {
+		return nil, fmt.Errorf("bucket_paths of %s requires +Inf bucket or count_path", name)
+	}
+	h.bucketedVec = &bucketedVec{
+		desc:   m.newDesc(name, m.labelKeys),
+		series: make(map[string]*bucketedSeries),
+	}
+	if err := reg.Register(h.bucketedVec); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// read returns the number of observations of the buckets and the count and
+// the sum of the event.
+func (h *BucketedHistogram) read(ev *event) ([]uint64, uint64, float64, error) {
+	counts := make([]uint64, len(h.bounds))
+	for i, p := range h.paths {
+		v, err := h.readCount(ev, p)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		if i > 0 && v < counts[i-1] {
+			return nil, 0, 0, &handlerError{errNonMonotonic, fmt.Errorf("%s: bucket count %d is less than %d of the smaller bucket", p, v, counts[i-1])}
+		}
+		counts[i] = v
+	}
+	count := counts[len(counts)-1]
+	if h.CountPath != "" {
+		v, err := h.readCount(ev, h.CountPath)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		if v < count {
+			return nil, 0, 0, &handlerError{errNonMonotonic, fmt.Errorf("%s: count %d is less than %d of the largest bucket", h.CountPath, v, count)}
+		}
+		count = v
+	}
+	var sum float64
+	if h.SumPath != "" {
+		raw, found, err := h.lookup(ev, h.SumPath)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		if !found {
+			return nil, 0, 0, &handlerError{errMissing, fmt.Errorf("%s: missing value", h.SumPath)}
+		}
+		if sum, err = h.convert(raw, h.SumPath); err != nil {
+			return nil, 0, 0, err
+		}
+	}
+	return counts, count, sum, nil
+}
+
+func (h *BucketedHistogram) readCount(ev *event, p string) (uint64, error) {
+	raw, found, err := h.lookup(ev, p)
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, &handlerError{errMissing, fmt.Errorf("%s: missing value", p)}
+	}
+	v, err := h.convert(raw, p)
+	if err != nil {
+		return 0, err
+	}
+	if v < 0 || math.IsNaN(v) {
+		return 0, &handlerError{errNegativeCounter, fmt.Errorf("%s: bucket count must be >=0", p)}
+	}
+	return uint64(v), nil
+}
+
+func (h *BucketedHistogram) HandleEvent(ev *event) error {
+	ls := h.scratch()
+	defer h.release(ls)
+	lvals, err := h.labelValues(ev, "", ls)
+	if err != nil {
+		return err
+	}
+	counts, count, sum, err := h.read(ev)
+	if err != nil {
+		return err
+	}
+	key := seriesKey(lvals)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok || h.BucketUpdate == "replace" {
+		s = &bucketedSeries{values: append([]string(nil), lvals...), buckets: make(map[float64]uint64)}
+		h.series[key] = s
+	}
+	for i, bound := range h.bounds {
+		if !math.IsInf(bound, 1) {
+			s.buckets[bound] += counts[i]
+		}
+	}
+	s.count += count
+	s.sum += sum
+	return nil
+}
@@ -0,0 +1,145 @@
+package outprom
+
+import (
+	"hash/maphash"
+	"sync"
+	"sync/atomic"
+)
+
+// childCacheShards is the number of shards of a child cache, a power of two.
+const childCacheShards = 16
+
+// childCache caches the children of a metric vector by label values, saving
+// WithLabelValues from hashing the label values of frequently updated series
+// and from the lock of the vector. The cache is split into shards by the hash
+// of the label values. A hit only reads the immutable map of its shard
+// through an atomic pointer; a miss copies the map of the shard under the
+// lock of the shard, so caching a new series costs O(size/shards). Once a
+// shard is full, entries not hit since its previous eviction are dropped
+// first.
+type childCache struct {
+	seed   maphash.Seed
+	shards [childCacheShards]cacheShard
+}
+
+type cacheShard struct {
+	size    int
+	entries atomic.Pointer[map[uint64]*cacheEntry]
+	mu      sync.Mutex
+}
+
+type cacheEntry struct {
+	lvals []string
+	child interface{}
+	used  int32
+}
+
+func newChildCache(size int) *childCache {
+	c := &childCache{seed: maphash.MakeSeed()}
+	per := (size + childCacheShards - 1) / childCacheShards
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.size = per
+		entries := make(map[uint64]*cacheEntry)
+		s.entries.Store(&entries)
+	}
+	return c
+}
+
+func (c *childCache) hash(lvals []string) uint64 {
+	var h maphash.Hash
+	h.SetSeed(c.seed)
+	for _, v := range lvals {
+		h.WriteString(v)
+		h.WriteByte(0xff)
+	}
+	return h.Sum64()
+}
+
+func (c *childCache) shard(key uint64) *cacheShard {
+	return &c.shards[key&(childCacheShards-1)]
+}
+
+// len returns the number of cached children.
+func (c *childCache) len() int {
+	n := 0
+	for i := range c.shards {
+		n += len(*c.shards[i].entries.Load())
+	}
+	return n
+}
+
+// get returns the cached child of the label values, calling create on a miss.
+// create runs under the lock of the shard so that a concurrent delete cannot
+// slip in between creating and caching the child.
+func (c *childCache) get(lvals []string, create func() interface{}) interface{} {
+	key := c.hash(lvals)
+	s := c.shard(key)
+	if e, ok := (*s.entries.Load())[key]; ok && equalStrings(e.lvals, lvals) {
+		if atomic.LoadInt32(&e.used) == 0 {
+			atomic.StoreInt32(&e.used, 1)
+		}
+		return e.child
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := *s.entries.Load()
+	if e, ok := old[key]; ok {
+		if equalStrings(e.lvals, lvals) {
+			return e.child
+		}
+		// A hash collision is not cached; the vector resolves it.
+		return create()
+	}
+	child := create()
+	entries := s.evict(old)
+	entries[key] = &cacheEntry{lvals: append([]string(nil), lvals...), child: child, used: 1}
+	s.entries.Store(&entries)
+	return child
+}
+
+// evict returns a copy of old with room for another entry.
+func (s *cacheShard) evict(old map[uint64]*cacheEntry) map[uint64]*cacheEntry {
+	entries := make(map[uint64]*cacheEntry, len(old)+1)
+	if len(old) < s.size {
+		for k, e := range old {
+			entries[k] = e
+		}
+		return entries
+	}
+	for k, e := range old {
+		if atomic.SwapInt32(&e.used, 0) == 1 {
+			entries[k] = e
+		}
+	}
+	for k := range entries {
+		if len(entries) < s.size {
+			break
+		}
+		delete(entries, k)
+	}
+	return entries
+}
+
+// delete drops the child of the label values and then calls del, which
+// deletes the series from the vector, under the lock of the shard. A get
+// starting after the child is dropped waits for the series to be deleted and
+// creates a fresh one, so no update goes to the detached child except from a
+// get which already returned it, as with WithLabelValues.
+func (c *childCache) delete(lvals []string, del func() bool) bool {
+	key := c.hash(lvals)
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := *s.entries.Load()
+	if e, ok := old[key]; ok && equalStrings(e.lvals, lvals) {
+		entries := make(map[uint64]*cacheEntry, len(old))
+		for k, e := range old {
+			if k != key {
+				entries[k] = e
+			}
+		}
+		s.entries.Store(&entries)
+	}
+	return del()
+}
@@ -0,0 +1,210 @@
+package outprom
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestChildCacheEviction(t *testing.T) {
+	const size = 2 * childCacheShards
+	c := newChildCache(size)
+	created := 0
+	get := func(v string) interface{} {
+		return c.get([]string{v}, func() interface{} { created++; return v })
+	}
+	get("a")
+	get("b")
+	get("a")
+	if created != 2 {
+		t.Fatalf("created %d children, want 2", created)
+	}
+	for i := 0; i < 1000; i++ {
+		v := fmt.Sprint(i)
+		if got := get(v); got != v {
+			t.Fatalf("get(%s) = %v", v, got)
+		}
+	}
+	if n := c.len(); n > size {
+		t.Errorf("cache holds %d entries, want at most %d", n, size)
+	}
+	n := created
+	if got := get("999"); got != "999" || created != n {
+		t.Errorf("get(999) = %v after %d creations, want a hit", got, created-n)
+	}
+}
+
+func TestChildCacheDelete(t *testing.T) {
+	c := newChildCache(8)
+	c.get([]string{"a"}, func() interface{} { return 1 })
+	deleted := c.delete([]string{"a"}, func() bool {
+		// The child is forgotten before the series is deleted, so a get at
+		// this point would miss and create a fresh child.
+		if n := c.len(); n != 0 {
+			t.Errorf("cache holds %d entries while deleting", n)
+		}
+		return true
+	})
+	if !deleted {
+		t.Error("delete did not report the result of del")
+	}
+	if got := c.get([]string{"a"}, func() interface{} { return 2 }); got != 2 {
+		t.Errorf("get after delete = %v, want a fresh child", got)
+	}
+}
+
+func TestCounterResurrectsDeletedSeries(t *testing.T) {
+	h, _ := newTestHandler(t, `
+type = "counter"
+value = "count"
+labels = { path = "path" }
+ttl = "1h"
+child_cache_size = 8
+`)
+	c := h.(*Counter)
+	if c.cache == nil {
+		t.Fatal("child_cache_size did not enable the cache")
+	}
+	for _, del := range []struct {
+		name string
+		f    func() bool
+	}{
+		{"DeleteLabelValues", func() bool { return c.DeleteLabelValues("/a") }},
+		{"TTL", func() bool {
+			c.expiry().expire(time.Now().Add(2 * time.Hour))
+			return testutilCount(c.CounterVec) == 0
+		}},
+	} {
+		handle(t, h, newEvent("t", map[string]interface{}{"count": 2.0, "path": "/a"}))
+		if !del.f() {
+			t.Fatalf("%s did not delete the series", del.name)
+		}
+		handle(t, h, newEvent("t", map[string]interface{}{"count": 3.0, "path": "/a"}))
+		if got := testutil.ToFloat64(c.CounterVec.WithLabelValues("/a")); got != 3 {
+			t.Errorf("series resurrected after %s = %v, want 3", del.name, got)
+		}
+		if c.child([]string{"/a"}) != c.CounterVec.WithLabelValues("/a") {
+			t.Errorf("cached child is detached after %s", del.name)
+		}
+		c.DeleteLabelValues("/a")
+	}
+}
+
+// TestCounterCacheConcurrentDelete checks that a series deleted while it is
+// being updated, directly or by the TTL sweep, never leaves a detached child
+// in the cache.
+func TestCounterCacheConcurrentDelete(t *testing.T) {
+	h, _ := newTestHandler(t, `
+type = "counter"
+value = "count"
+labels = { path = "path" }
+ttl = "1h"
+child_cache_size = 8
+`)
+	c := h.(*Counter)
+	paths := []string{"/a", "/b", "/c", "/d"}
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	swept := make(chan struct{})
+	go func() {
+		defer close(swept)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				c.expiry().expire(time.Now().Add(2 * time.Hour))
+			}
+		}
+	}()
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; n < 2000; n++ {
+				lvals := []string{paths[(i+n)%len(paths)]}
+				if n%7 == i {
+					c.DeleteLabelValues(lvals...)
+				} else if err := h.HandleEvent(newEvent("t", map[string]interface{}{"count": 1.0, "path": lvals[0]})); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(stop)
+	<-swept
+	for _, p := range paths {
+		cached := c.child([]string{p})
+		if live := c.CounterVec.WithLabelValues(p); cached != live {
+			t.Errorf("cached child of %s is detached from the vector", p)
+		}
+	}
+}
+
+// benchHandler creates a metric of typ labelled by 3 labels with the given
+// child_cache_size, and 50 label value tuples to update it with.
+func benchHandler(b *testing.B, typ string, size int) (Handler, [][]string) {
+	m := decodeMetric(b, fmt.Sprintf(`
+type = %q
+value = "count"
+labels = { a = "a", b = "b", c = "c" }
+child_cache_size = %d
+`, typ, size))
+	h, err := m.New("test", prometheus.NewRegistry(), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	tuples := make([][]string, 50)
+	for i := range tuples {
+		tuples[i] = []string{fmt.Sprint(i % 2), fmt.Sprint(i % 5), fmt.Sprint(i)}
+	}
+	return h, tuples
+}
+
+func BenchmarkCounterChild(b *testing.B) {
+	for _, size := range []int{0, 1024} {
+		b.Run(fmt.Sprintf("child_cache_size=%d", size), func(b *testing.B) {
+			h, tuples := benchHandler(b, "counter", size)
+			c := h.(*Counter)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				c.child(tuples[i%len(tuples)]).Inc()
+			}
+		})
+	}
+}
+
+func BenchmarkGaugeChild(b *testing.B) {
+	for _, size := range []int{0, 1024} {
+		b.Run(fmt.Sprintf("child_cache_size=%d", size), func(b *testing.B) {
+			h, tuples := benchHandler(b, "gauge", size)
+			g := h.(*Gauge)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				g.child(tuples[i%len(tuples)]).Set(1)
+			}
+		})
+	}
+}
+
+func BenchmarkCounterChildParallel(b *testing.B) {
+	for _, size := range []int{0, 1024} {
+		b.Run(fmt.Sprintf("child_cache_size=%d", size), func(b *testing.B) {
+			h, tuples := benchHandler(b, "counter", size)
+			c := h.(*Counter)
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					c.child(tuples[i%len(tuples)]).Inc()
+					i++
+				}
+			})
+		})
+	}
+}
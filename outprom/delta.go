@@ -0,0 +1,38 @@
+package outprom
+
+import "sync"
+
+// deltaTracker remembers the last cumulative value of each label set to turn
+// cumulative source values into counter increments.
+type deltaTracker struct {
+	mu   sync.Mutex
+	last map[string]float64
+}
+
+func newDeltaTracker() *deltaTracker {
+	return &deltaTracker{last: make(map[string]float64)}
+}
+
+// delta returns the increment from the last value of the label set. The first
+// value only establishes the baseline, and a decrease is treated as a reset of
+// the source counter so the current value is the increment.
+func (d *deltaTracker) delta(lvals []string, v float64) float64 {
+	key := seriesKey(lvals)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	last, ok := d.last[key]
+	d.last[key] = v
+	switch {
+	case !ok:
+		return 0
+	case v < last:
+		return v
+	}
+	return v - last
+}
+
+func (d *deltaTracker) forget(key string) {
+	d.mu.Lock()
+	delete(d.last, key)
+	d.mu.Unlock()
+}
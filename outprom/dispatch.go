@@ -0,0 +1,65 @@
+package outprom
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// maxCachedTags bounds the number of tags whose handlers are cached, in case
+// tags turn out to be high-cardinality.
+const maxCachedTags = 10000
+
+// dispatcher resolves the handlers matching a tag. Handlers of a literal tag
+// are looked up from a map and only the rest are matched one by one. The
+// result is cached per tag.
+type dispatcher struct {
+	exact    map[string][]int
+	wildcard []int
+	handlers []Handler
+	cache    sync.Map
+	cached   int64
+}
+
+func newDispatcher(handlers []Handler) *dispatcher {
+	d := &dispatcher{exact: make(map[string][]int), handlers: handlers}
+	for i, h := range handlers {
+		if tag, ok := h.exactTag(); ok {
+			d.exact[tag] = append(d.exact[tag], i)
+		} else {
+			d.wildcard = append(d.wildcard, i)
+		}
+	}
+	return d
+}
+
+// match returns the handlers matching the tag in the order of the handlers.
+func (d *dispatcher) match(tag string) []Handler {
+	if hs, ok := d.cache.Load(tag); ok {
+		return hs.([]Handler)
+	}
+	idx := append([]int(nil), d.exact[tag]...)
+	for _, i := range d.wildcard {
+		if d.handlers[i].MatchTag(tag) {
+			idx = append(idx, i)
+		}
+	}
+	sort.Ints(idx)
+	hs := make([]Handler, len(idx))
+	for j, i := range idx {
+		hs[j] = d.handlers[i]
+	}
+	if atomic.AddInt64(&d.cached, 1) <= maxCachedTags {
+		d.cache.Store(tag, hs)
+	}
+	return hs
+}
+
+// exactTag returns the tag if the metric only matches that literal tag.
+func (m *Metric) exactTag() (string, bool) {
+	if m.Tag == "" || m.TagPattern != "" || strings.Contains(m.Tag, "*") || strings.HasPrefix(m.Tag, "/") {
+		return "", false
+	}
+	return m.Tag, true
+}
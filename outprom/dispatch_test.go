@@ -0,0 +1,73 @@
+package outprom
+
+import (
+	"fmt"
+	"testing"
+)
+
+// tagMetrics returns n counters, each on its own literal tag "app.<i>", and
+// one on the pattern "app.*".
+func tagMetrics(t testing.TB, n int) map[string]Metric {
+	metrics := make(map[string]Metric, n+1)
+	for i := 0; i < n; i++ {
+		metrics[fmt.Sprintf("m%03d", i)] = decodeMetric(t, fmt.Sprintf("type = \"counter\"\ntag = \"app.%d\"\n", i))
+	}
+	metrics["all"] = decodeMetric(t, "type = \"counter\"\ntag = \"app.*\"\n")
+	return metrics
+}
+
+func TestDispatcherMatch(t *testing.T) {
+	p := newTestPlugin(t, tagMetrics(t, 10))
+	handlers := p.loadHandlers()
+	for _, tag := range []string{"app.3", "app.none", "other"} {
+		var want []Handler
+		for _, h := range handlers {
+			if h.MatchTag(tag) {
+				want = append(want, h)
+			}
+		}
+		// Twice, the second time from the cache.
+		for i := 0; i < 2; i++ {
+			got := p.matchHandlers(tag)
+			if !sameHandlers(got, want) {
+				t.Errorf("%s: got %d handlers, want %d", tag, len(got), len(want))
+			}
+		}
+	}
+}
+
+func sameHandlers(a, b []Handler) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// BenchmarkDispatch compares matching 100 metrics one by one against the
+// tag-indexed dispatcher.
+func BenchmarkDispatch(b *testing.B) {
+	p := newTestPlugin(b, tagMetrics(b, 100))
+	handlers := p.loadHandlers()
+	b.Run("loop", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			n := 0
+			for _, h := range handlers {
+				if h.MatchTag("app.42") {
+					n++
+				}
+			}
+		}
+	})
+	b.Run("indexed", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			p.matchHandlers("app.42")
+		}
+	})
+}
@@ -0,0 +1,282 @@
+package outprom
+
+import (
+	"container/list"
+	"fmt"
+	"hash/maphash"
+	"math"
+	"math/bits"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultMaxDistinct = 10000
+	defaultPrecision   = 12
+	// approxSlots is the number of sketches a window is divided into in the
+	// approximate mode. Values expire at the granularity of a slot.
+	approxSlots = 4
+)
+
+type DistinctMode string
+
+func (m *DistinctMode) UnmarshalText(b []byte) error {
+	s := string(b)
+	switch s {
+	case "exact", "approx":
+		*m = DistinctMode(s)
+		return nil
+	}
+	return fmt.Errorf("Unknown distinct mode: %s", s)
+}
+
+// distinctCounter counts the distinct values seen within a window.
+type distinctCounter interface {
+	add(v string, now time.Time)
+	count(now time.Time) float64
+}
+
+// exactCounter remembers every value up to a hard cap. Once the cap is
+// reached, new values are not counted until old ones expire. The values are
+// kept in the order they were last seen, so expiring only visits the values
+// which expire.
+type exactCounter struct {
+	window time.Duration
+	max    int
+	seen   map[string]*list.Element
+	order  list.List // of *seenValue, least recently seen first
+}
+
+type seenValue struct {
+	v string
+	t time.Time
+}
+
+func newExactCounter(window time.Duration, max int) *exactCounter {
+	return &exactCounter{window: window, max: max, seen: make(map[string]*list.Element)}
+}
+
+func (c *exactCounter) add(v string, now time.Time) {
+	if e, ok := c.seen[v]; ok {
+		e.Value.(*seenValue).t = now
+		c.order.MoveToBack(e)
+		return
+	}
+	if len(c.seen) >= c.max {
+		c.expire(now)
+		if len(c.seen) >= c.max {
+			return
+		}
+	}
+	c.seen[v] = c.order.PushBack(&seenValue{v, now})
+}
+
+func (c *exactCounter) expire(now time.Time) {
+	if c.window == 0 {
+		return
+	}
+	for e := c.order.Front(); e != nil; e = c.order.Front() {
+		s := e.Value.(*seenValue)
+		if now.Sub(s.t) < c.window {
+			return
+		}
+		c.order.Remove(e)
+		delete(c.seen, s.v)
+	}
+}
+
+func (c *exactCounter) count(now time.Time) float64 {
+	c.expire(now)
+	return float64(len(c.seen))
+}
+
+// hllCounter estimates the number of distinct values with HyperLogLog. The
+// window is covered by a ring of sketches which are merged on count.
+type hllCounter struct {
+	seed      maphash.Seed
+	precision uint8
+	slotLen   time.Duration
+	slots     [approxSlots]hllSlot
+}
+
+type hllSlot struct {
+	start     int64
+	registers []uint8
+}
+
+func (c *hllCounter) slot(now time.Time) int64 {
+	if c.slotLen == 0 {
+		return 0
+	}
+	return now.UnixNano() / int64(c.slotLen)
+}
+
+func (c *hllCounter) add(v string, now time.Time) {
+	n := c.slot(now)
+	s := &c.slots[n%approxSlots]
+	if s.registers == nil || s.start != n {
+		s.start = n
+		s.registers = make([]uint8, 1<<c.precision)
+	}
+	h := maphash.String(c.seed, v)
+	idx := h >> (64 - c.precision)
+	rho := uint8(bits.LeadingZeros64(h<<c.precision|1<<(c.precision-1))) + 1
+	if rho > s.registers[idx] {
+		s.registers[idx] = rho
+	}
+}
+
+func (c *hllCounter) count(now time.Time) float64 {
+	n := c.slot(now)
+	m := 1 << c.precision
+	merged := make([]uint8, m)
+	for _, s := range c.slots {
+		if s.registers == nil || s.start <= n-approxSlots {
+			continue
+		}
+		for i, r := range s.registers {
+			if r > merged[i] {
+				merged[i] = r
+			}
+		}
+	}
+	var sum float64
+	var zeros int
+	for _, r := range merged {
+		sum += 1 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+	fm := float64(m)
+	e := 0.7213 / (1 + 1.079/fm) * fm * fm / sum
+	if e <= 2.5*fm && zeros > 0 {
+		e = fm * math.Log(fm/float64(zeros))
+	}
+	return math.Round(e)
+}
+
+// distinctVec is a collector of gauges which export the number of distinct
+// values per label set.
+type distinctVec struct {
+	desc   *prometheus.Desc
+	newCtr func() distinctCounter
+	mu     sync.Mutex
+	series map[string]*distinctSeries
+}
+
+type distinctSeries struct {
+	values  []string
+	counter distinctCounter
+}
+
+func newDistinctVec(name string, m *Metric) (*distinctVec, error) {
+	window := m.Window.Duration
+	v := &distinctVec{
+		desc:   m.newDesc(name, m.labelKeys),
+		series: make(map[string]*distinctSeries),
+	}
+	switch m.DistinctMode {
+	case "", "exact":
+		max := m.MaxDistinct
+		if max == 0 {
+			max = defaultMaxDistinct
+		}
+		v.newCtr = func() distinctCounter {
+			return newExactCounter(window, max)
+		}
+	case "approx":
+		precision := m.Precision
+		if precision == 0 {
+			precision = defaultPrecision
+		}
+		if precision < 4 || precision > 16 {
+			return nil, fmt.Errorf("Precision of %s must be between 4 and 16", name)
+		}
+		seed := maphash.MakeSeed()
+		v.newCtr = func() distinctCounter {
+			return &hllCounter{seed: seed, precision: precision, slotLen: window / approxSlots}
+		}
+	}
+	return v, nil
+}
+
+func (d *distinctVec) add(lvals []string, value string) {
+	key := seriesKey(lvals)
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s, ok := d.series[key]
+	if !ok {
+		s = &distinctSeries{values: append([]string(nil), lvals...), counter: d.newCtr()}
+		d.series[key] = s
+	}
+	s.counter.add(value, now)
+}
+
+func (d *distinctVec) Describe(ch chan<- *prometheus.Desc) {
+	ch <- d.desc
+}
+
+func (d *distinctVec) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, s := range d.series {
+		ch <- prometheus.MustNewConstMetric(d.desc, prometheus.GaugeValue, s.counter.count(now), s.values...)
+	}
+}
+
+func (d *distinctVec) DeleteLabelValues(lvals ...string) bool {
+	key := seriesKey(lvals)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, ok := d.series[key]
+	delete(d.series, key)
+	return ok
+}
+
+// Distinct is a gauge of the number of distinct values of the value field.
+type Distinct struct {
+	Metric
+	*distinctVec
+}
+
+func newDistinct(name string, m *Metric, reg prometheus.Registerer) (*Distinct, error) {
+	v, err := newDistinctVec(name, m)
+	if err != nil {
+		return nil, err
+	}
+	if err := reg.Register(v); err != nil {
+		return nil, err
+	}
+	return &Distinct{Metric: *m, distinctVec: v}, nil
+}
+
+func (d *Distinct) HandleEvent(ev *event) error {
+	ls := d.scratch()
+	defer d.release(ls)
+	for _, e := range d.values {
+		raw, found, err := d.lookup(ev, e.path)
+		if err != nil {
+			return err
+		}
+		if !found {
+			continue
+		}
+		s, ok := toString(raw)
+		if !ok {
+			return &handlerError{errTypeMismatch, fmt.Errorf("%s: cannot count distinct values of %T", e.path, raw)}
+		}
+		lvals, err := d.labelValues(ev, e.key, ls)
+		if err == errSkip {
+			continue
+		} else if err != nil {
+			return err
+		}
+		d.add(lvals, s)
+	}
+	return nil
+}
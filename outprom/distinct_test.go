@@ -0,0 +1,45 @@
+package outprom
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestExactCounter(t *testing.T) {
+	now := time.Now()
+	c := newExactCounter(time.Minute, 2)
+	c.add("a", now)
+	c.add("b", now.Add(10*time.Second))
+	c.add("c", now.Add(20*time.Second))
+	if n := c.count(now.Add(20 * time.Second)); n != 2 {
+		t.Errorf("count = %v at the cap, want 2", n)
+	}
+	// Seeing a again keeps it from expiring before b.
+	c.add("a", now.Add(30*time.Second))
+	c.add("c", now.Add(70*time.Second))
+	if n := c.count(now.Add(70 * time.Second)); n != 2 {
+		t.Errorf("count = %v after b expired, want 2", n)
+	}
+	if _, ok := c.seen["b"]; ok {
+		t.Error("b did not expire first")
+	}
+	if n := c.count(now.Add(3 * time.Minute)); n != 0 {
+		t.Errorf("count = %v after the window, want 0", n)
+	}
+}
+
+// BenchmarkExactCounterFull measures adding new values to a counter at its
+// cap with none of the values expired.
+func BenchmarkExactCounterFull(b *testing.B) {
+	now := time.Now()
+	c := newExactCounter(time.Hour, defaultMaxDistinct)
+	for i := 0; i < defaultMaxDistinct; i++ {
+		c.add(strconv.Itoa(i), now)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.add("new", now)
+	}
+}
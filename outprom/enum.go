@@ -0,0 +1,128 @@
+package outprom
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const unknownState = "unknown"
+
+// Enum is a state set: a gauge having a series per state, labeled by
+// state_label, which is 1 for the current state and 0 for the others. A value
+// not in states is either the "unknown" state or an error per unknown_state.
+type Enum struct {
+	Metric
+	vec    *prometheus.GaugeVec
+	states []string
+	known  map[string]bool
+}
+
+func newEnum(name string, m *Metric, reg prometheus.Registerer) (*Enum, error) {
+	if len(m.States) == 0 {
+		return nil, fmt.Errorf("states of %s is required by type = \"enum\"", name)
+	}
+	if m.Value.isEmpty() {
+		return nil, fmt.Errorf("value of %s is required by type = \"enum\"", name)
+	}
+	if m.StateLabel == "" {
+		m.StateLabel = "state"
+	}
+	if err := validateLabelName(name, m.StateLabel); err != nil {
+		return nil, err
+	}
+	for _, key := range m.labelKeys {
+		if key == m.StateLabel {
+			return nil, fmt.Errorf("Label %s of %s is reserved by state_label", key, name)
+		}
+	}
+	if _, ok := m.ConstLabels[m.StateLabel]; ok {
+		return nil, fmt.Errorf("Label %s of %s is reserved by state_label", m.StateLabel, name)
+	}
+	switch m.UnknownState {
+	case "":
+		m.UnknownState = unknownState
+	case unknownState, "error":
+	default:
+		return nil, fmt.Errorf("Unknown unknown_state of %s: %s", name, m.UnknownState)
+	}
+	e := &Enum{Metric: *m, states: m.States, known: make(map[string]bool)}
+	for _, s := range m.States {
+		e.known[s] = true
+	}
+	if m.UnknownState == unknownState && !e.known[unknownState] {
+		e.states = append(e.states, unknownState)
+	}
+	keys := append(append([]string(nil), m.labelKeys...), m.StateLabel)
+	e.vec = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: m.Help, ConstLabels: m.ConstLabels, Unit: m.Unit}, keys)
+	if err := reg.Register(e.vec); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *Enum) HandleEvent(ev *event) error {
+	var first error
+	for _, v := range e.values {
+		if err := e.set(ev, v); err != nil && err != errSkip && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (e *Enum) set(ev *event, v valueEntry) error {
+	raw, found, err := e.lookup(ev, v.path)
+	if err != nil {
+		return err
+	}
+	if !found {
+		_, err := e.missing(v.path)
+		if err == nil {
+			err = errSkip
+		}
+		return err
+	}
+	state, ok := toString(raw)
+	if !ok {
+		return &handlerError{errTypeMismatch, fmt.Errorf("%s: cannot convert %T to state", v.path, raw)}
+	}
+	if !e.known[state] {
+		if e.UnknownState == "error" {
+			return &handlerError{errUnknownValue, fmt.Errorf("%s: %q is not defined in states", v.path, state)}
+		}
+		state = unknownState
+	}
+	ls := e.scratch()
+	defer e.release(ls)
+	lvals, err := e.labelValues(ev, v.key, ls)
+	if err != nil {
+		return err
+	}
+	for _, s := range e.states {
+		var x float64
+		if s == state {
+			x = 1
+		}
+		e.vec.WithLabelValues(append(lvals[:len(lvals):len(lvals)], s)...).Set(x)
+	}
+	return nil
+}
+
+func (e *Enum) DeleteLabelValues(lvals ...string) bool {
+	deleted := false
+	for _, s := range e.states {
+		if e.vec.DeleteLabelValues(append(lvals[:len(lvals):len(lvals)], s)...) {
+			deleted = true
+		}
+	}
+	return deleted
+}
+
+func (e *Enum) Describe(ch chan<- *prometheus.Desc) {
+	e.vec.Describe(ch)
+}
+
+func (e *Enum) Collect(ch chan<- prometheus.Metric) {
+	e.vec.Collect(ch)
+}
@@ -0,0 +1,97 @@
+package outprom
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// resolve expands the environment variables in the config and merges the
+// metrics of metrics_dir. The settings are expanded first so that metrics_dir
+// itself may refer to variables, and the metrics after merging so that those
+// of metrics_dir are expanded too.
+func (c *Config) resolve() error {
+	expand, undefined := expander()
+	c.expandSettings(expand)
+	if err := c.loadMetricsDir(); err != nil {
+		return err
+	}
+	c.expandMetrics(expand)
+	if c.StrictEnv && len(undefined) > 0 {
+		names := make([]string, 0, len(undefined))
+		for name := range undefined {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("Undefined environment variables: %s", strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// expander returns a function expanding ${VAR} and $VAR, $$ being a literal
+// $, and the set of undefined variables it came across.
+func expander() (func(string) string, map[string]bool) {
+	undefined := make(map[string]bool)
+	expand := func(s string) string {
+		return os.Expand(s, func(name string) string {
+			if name == "$" {
+				return "$"
+			}
+			v, ok := os.LookupEnv(name)
+			if !ok {
+				undefined[name] = true
+			}
+			return v
+		})
+	}
+	return expand, undefined
+}
+
+// expandSettings expands the string settings other than the metrics.
+func (c *Config) expandSettings(expand func(string) string) {
+	for _, s := range []*string{
+		&c.Listen.Address, &c.SocketMode, &c.Path, &c.PushgatewayURL, &c.Job,
+		&c.TextfilePath, &c.TLSCert, &c.TLSKey, &c.TLSClientCA,
+		&c.Username, &c.Password, &c.AuthToken, &c.PortFile, &c.StateFile,
+		&c.MetricsDir, &c.GraphiteAddress, &c.GraphitePrefix,
+	} {
+		*s = expand(*s)
+	}
+	for i := range c.Listen.Listeners {
+		l := &c.Listen.Listeners[i]
+		for _, s := range []*string{
+			&l.Address, &l.SocketMode, &l.TLSCert, &l.TLSKey, &l.TLSClientCA,
+			&l.Username, &l.Password, &l.AuthToken,
+		} {
+			*s = expand(*s)
+		}
+	}
+	// The maps are replaced rather than modified, as they may be shared with
+	// a copy of the config.
+	if c.Grouping != nil {
+		grouping := make(map[string]string, len(c.Grouping))
+		for k, v := range c.Grouping {
+			grouping[k] = expand(v)
+		}
+		c.Grouping = grouping
+	}
+}
+
+// expandMetrics expands the help and const labels of the metrics. Metric
+// names and label names are left as is.
+func (c *Config) expandMetrics(expand func(string) string) {
+	metrics := make(map[string]Metric, len(c.Metrics))
+	for name, m := range c.Metrics {
+		m.Help = expand(m.Help)
+		if m.ConstLabels != nil {
+			labels := make(map[string]string, len(m.ConstLabels))
+			for k, v := range m.ConstLabels {
+				labels[k] = expand(v)
+			}
+			m.ConstLabels = labels
+		}
+		metrics[name] = m
+	}
+	c.Metrics = metrics
+}
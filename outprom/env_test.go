@@ -0,0 +1,40 @@
+package outprom
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveMetricsDir(t *testing.T) {
+	dir := t.TempDir()
+	src := "[metrics.hits]\ntype = \"counter\"\nhelp = \"Hits of ${APP}\"\n"
+	if err := os.WriteFile(filepath.Join(dir, "hits.toml"), []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("METRICS_DIR", dir)
+	t.Setenv("APP", "web")
+	t.Setenv("GRAPHITE", "graphite:2003")
+	conf := Config{
+		MetricsDir:      "${METRICS_DIR}",
+		GraphiteAddress: "${GRAPHITE}",
+		GraphitePrefix:  "${APP}.",
+		StrictEnv:       true,
+	}
+	if err := conf.resolve(); err != nil {
+		t.Fatal(err)
+	}
+	if got := conf.Metrics["hits"].Help; got != "Hits of web" {
+		t.Errorf("help = %q, want %q", got, "Hits of web")
+	}
+	if conf.GraphiteAddress != "graphite:2003" || conf.GraphitePrefix != "web." {
+		t.Errorf("graphite = %q %q", conf.GraphiteAddress, conf.GraphitePrefix)
+	}
+}
+
+func TestResolveStrictEnv(t *testing.T) {
+	conf := Config{GraphitePrefix: "${OUTPROM_UNDEFINED}", StrictEnv: true}
+	if err := conf.resolve(); err == nil {
+		t.Error("undefined variable is not an error")
+	}
+}
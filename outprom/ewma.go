@@ -0,0 +1,68 @@
+package outprom
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// ewma keeps an exponentially weighted moving average per label set. The
+// weight of a new value is either the fixed alpha, or derived from half_life
+// and the time elapsed since the previous value.
+type ewma struct {
+	alpha    float64
+	halfLife time.Duration
+	mu       sync.Mutex
+	series   map[string]*ewmaState
+}
+
+type ewmaState struct {
+	value   float64
+	updated time.Time
+}
+
+func newEWMA(name string, m *Metric) (*ewma, error) {
+	if m.Smoothing != "ewma" {
+		return nil, fmt.Errorf("Unknown smoothing of %s: %s", name, m.Smoothing)
+	}
+	e := &ewma{halfLife: m.HalfLife.Duration, series: make(map[string]*ewmaState)}
+	if m.Alpha != nil {
+		e.alpha = *m.Alpha
+	}
+	switch {
+	case m.Alpha != nil && e.halfLife > 0:
+		return nil, fmt.Errorf("alpha and half_life of %s are exclusive", name)
+	case m.Alpha == nil && e.halfLife == 0:
+		return nil, fmt.Errorf("alpha or half_life of %s is required by smoothing = \"ewma\"", name)
+	case m.Alpha != nil && (e.alpha <= 0 || e.alpha > 1):
+		return nil, fmt.Errorf("alpha of %s must be in (0, 1]: %v", name, e.alpha)
+	}
+	return e, nil
+}
+
+// update returns the average after observing v.
+func (e *ewma) update(lvals []string, v float64) float64 {
+	key := seriesKey(lvals)
+	now := time.Now()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	s, ok := e.series[key]
+	if !ok {
+		e.series[key] = &ewmaState{value: v, updated: now}
+		return v
+	}
+	alpha := e.alpha
+	if e.halfLife > 0 {
+		alpha = 1 - math.Exp(-math.Ln2*now.Sub(s.updated).Seconds()/e.halfLife.Seconds())
+	}
+	s.value += alpha * (v - s.value)
+	s.updated = now
+	return s.value
+}
+
+func (e *ewma) forget(key string) {
+	e.mu.Lock()
+	delete(e.series, key)
+	e.mu.Unlock()
+}
@@ -0,0 +1,72 @@
+package outprom
+
+import (
+	"fmt"
+	"sort"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// exemplar returns the exemplar labels of the event per exemplar_labels, or
+// nil if none is found. The values are truncated so that the labels fit in
+// prometheus.ExemplarMaxRunes, as client_golang rejects longer exemplars.
+func (m *Metric) exemplar(ev *event) prometheus.Labels {
+	if len(m.ExemplarLabels) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(m.ExemplarLabels))
+	for name := range m.ExemplarLabels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var labels prometheus.Labels
+	budget := prometheus.ExemplarMaxRunes
+	for _, name := range names {
+		raw, found, err := m.lookup(ev, m.ExemplarLabels[name])
+		if err != nil || !found {
+			continue
+		}
+		var v string
+		switch t := raw.(type) {
+		case string:
+			v = t
+		case []byte:
+			v = string(t)
+		default:
+			v = fmt.Sprint(t)
+		}
+		if v == "" {
+			continue
+		}
+		budget -= utf8.RuneCountInString(name)
+		if budget <= 0 {
+			break
+		}
+		if n := utf8.RuneCountInString(v); n > budget {
+			v = string([]rune(v)[:budget])
+		}
+		budget -= utf8.RuneCountInString(v)
+		if labels == nil {
+			labels = make(prometheus.Labels)
+		}
+		labels[name] = v
+	}
+	return labels
+}
+
+func observeWithExemplar(o prometheus.Observer, v float64, exemplar prometheus.Labels) {
+	if eo, ok := o.(prometheus.ExemplarObserver); ok && exemplar != nil {
+		eo.ObserveWithExemplar(v, exemplar)
+		return
+	}
+	o.Observe(v)
+}
+
+func addWithExemplar(c prometheus.Counter, v float64, exemplar prometheus.Labels) {
+	if ea, ok := c.(prometheus.ExemplarAdder); ok && exemplar != nil {
+		ea.AddWithExemplar(v, exemplar)
+		return
+	}
+	c.Add(v)
+}
@@ -0,0 +1,229 @@
+package outprom
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	errMissingOperand = errors.New("missing operand")
+	errDivisionByZero = errors.New("division by zero")
+)
+
+// expr is an arithmetic expression over record paths and numeric literals.
+type expr interface {
+	eval(resolve func(string) (float64, error)) (float64, error)
+}
+
+type numberExpr float64
+
+func (e numberExpr) eval(resolve func(string) (float64, error)) (float64, error) {
+	return float64(e), nil
+}
+
+type pathExpr string
+
+func (e pathExpr) eval(resolve func(string) (float64, error)) (float64, error) {
+	return resolve(string(e))
+}
+
+type binaryExpr struct {
+	op          byte
+	left, right expr
+}
+
+func (e *binaryExpr) eval(resolve func(string) (float64, error)) (float64, error) {
+	l, err := e.left.eval(resolve)
+	if err != nil {
+		return 0, err
+	}
+	r, err := e.right.eval(resolve)
+	if err != nil {
+		return 0, err
+	}
+	switch e.op {
+	case '+':
+		return l + r, nil
+	case '-':
+		return l - r, nil
+	case '*':
+		return l * r, nil
+	}
+	if r == 0 {
+		return 0, errDivisionByZero
+	}
+	return l / r, nil
+}
+
+type negExpr struct {
+	x expr
+}
+
+func (e negExpr) eval(resolve func(string) (float64, error)) (float64, error) {
+	v, err := e.x.eval(resolve)
+	return -v, err
+}
+
+// walkExprPaths calls f with each path referred to by the expression.
+func walkExprPaths(e expr, f func(string)) {
+	switch t := e.(type) {
+	case pathExpr:
+		f(string(t))
+	case *binaryExpr:
+		walkExprPaths(t.left, f)
+		walkExprPaths(t.right, f)
+	case negExpr:
+		walkExprPaths(t.x, f)
+	}
+}
+
+// parseExpr parses an expression consisting of +, -, *, /, parentheses,
+// numbers and paths. A bare path separates nested keys by dots, e.g.
+// "cache.hits / cache.total" or "items[0].price", and a literal dot in a key
+// is escaped by a backslash as in "user\.name". A double-quoted path is used
+// verbatim.
+func parseExpr(s string) (expr, error) {
+	p := &exprParser{s: s}
+	e, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	if p.skipSpace(); p.pos < len(p.s) {
+		return nil, fmt.Errorf("unexpected %q at %d", p.s[p.pos], p.pos)
+	}
+	return e, nil
+}
+
+type exprParser struct {
+	s   string
+	pos int
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.s) && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// skip advances past the characters in chars.
+func (p *exprParser) skip(chars string) {
+	for p.pos < len(p.s) && strings.IndexByte(chars, p.s[p.pos]) >= 0 {
+		p.pos++
+	}
+}
+
+func (p *exprParser) peek() byte {
+	if p.skipSpace(); p.pos < len(p.s) {
+		return p.s[p.pos]
+	}
+	return 0
+}
+
+func (p *exprParser) parseSum() (expr, error) {
+	e, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == '+' || op == '-'; op = p.peek() {
+		p.pos++
+		r, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		e = &binaryExpr{op, e, r}
+	}
+	return e, nil
+}
+
+func (p *exprParser) parseProduct() (expr, error) {
+	e, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == '*' || op == '/'; op = p.peek() {
+		p.pos++
+		r, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		e = &binaryExpr{op, e, r}
+	}
+	return e, nil
+}
+
+func (p *exprParser) parseUnary() (expr, error) {
+	switch c := p.peek(); {
+	case c == '-':
+		p.pos++
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return negExpr{x}, nil
+	case c == '(':
+		p.pos++
+		e, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("missing ) at %d", p.pos)
+		}
+		p.pos++
+		return e, nil
+	case c == '"':
+		end := strings.IndexByte(p.s[p.pos+1:], '"')
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated path at %d", p.pos)
+		}
+		path := p.s[p.pos+1 : p.pos+1+end]
+		p.pos += end + 2
+		return pathExpr(path), nil
+	case c >= '0' && c <= '9' || c == '.':
+		start := p.pos
+		p.skip("0123456789.")
+		if p.pos < len(p.s) && (p.s[p.pos] == 'e' || p.s[p.pos] == 'E') {
+			p.pos++
+			if p.pos < len(p.s) && (p.s[p.pos] == '+' || p.s[p.pos] == '-') {
+				p.pos++
+			}
+			p.skip("0123456789")
+		}
+		n, err := strconv.ParseFloat(p.s[start:p.pos], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", p.s[start:p.pos])
+		}
+		return numberExpr(n), nil
+	case isPathChar(c) || c == '\\' || c == '$':
+		var path []byte
+		for ; p.pos < len(p.s); p.pos++ {
+			c := p.s[p.pos]
+			if c == '\\' && p.pos+1 < len(p.s) && p.s[p.pos+1] == '.' {
+				p.pos++
+				path = append(path, '.')
+				continue
+			}
+			// $ may only start a path, as in $time and $lag.
+			if !isPathChar(c) && !(c >= '0' && c <= '9') && !(c == '$' && len(path) == 0) {
+				break
+			}
+			if c == '.' {
+				c = '/'
+			}
+			path = append(path, c)
+		}
+		if len(path) == 0 || string(path) == "$" {
+			return nil, fmt.Errorf("unexpected %q at %d", p.s[p.pos-len(path)], p.pos-len(path))
+		}
+		return pathExpr(path), nil
+	case c == 0:
+		return nil, errors.New("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected %q at %d", p.s[p.pos], p.pos)
+}
+
+func isPathChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == '.' || c == '[' || c == ']'
+}
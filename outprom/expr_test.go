@@ -0,0 +1,51 @@
+package outprom
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseExpr(t *testing.T) {
+	values := map[string]float64{"a": 2, "b/c": 3, "$time": 100, "$lag": 0.5}
+	resolve := func(p string) (float64, error) {
+		v, ok := values[p]
+		if !ok {
+			return 0, errors.New("unknown path " + p)
+		}
+		return v, nil
+	}
+	tests := []struct {
+		s    string
+		want float64
+	}{
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"-a", -2},
+		{"1e3", 1000},
+		{"1E3", 1000},
+		{"1e+3", 1000},
+		{"1e-3", 0.001},
+		{"2.5e-1 * 4", 1},
+		{"1e-3*a", 0.002},
+		{"a - 1e-3", 1.999},
+		{"b.c * a", 6},
+		{`"b/c" + 1`, 4},
+		{"$time - 1", 99},
+		{"$lag * 1000", 500},
+	}
+	for _, tt := range tests {
+		e, err := parseExpr(tt.s)
+		if err != nil {
+			t.Errorf("parseExpr(%q): %v", tt.s, err)
+			continue
+		}
+		if got, err := e.eval(resolve); err != nil || got != tt.want {
+			t.Errorf("%q = %v, %v, want %v", tt.s, got, err, tt.want)
+		}
+	}
+	for _, s := range []string{"1e", "1e+", "1 +", "a$b", "$", "(1"} {
+		if _, err := parseExpr(s); err == nil {
+			t.Errorf("parseExpr(%q) succeeded", s)
+		}
+	}
+}
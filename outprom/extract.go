@@ -0,0 +1,109 @@
+package outprom
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/yosisa/fluxion/message"
+)
+
+// event is an event as dispatched to the handlers. x holds the lookup results
+// shared by the handlers of the event, so that a path referred to by many
+// metrics is walked once per event. It is nil when a single handler uses the
+// event and for events expanded for json_fields, whose records differ.
+type event struct {
+	*message.Event
+	x *extraction
+}
+
+// pathIndex assigns ids to the paths looked up by the handlers of a plugin.
+// The id of a path is its slot in the extraction of an event.
+type pathIndex struct {
+	mu  sync.Mutex
+	ids map[string]int
+	n   atomic.Int32
+}
+
+func newPathIndex() *pathIndex {
+	return &pathIndex{ids: make(map[string]int)}
+}
+
+func (ix *pathIndex) id(p string) int {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	id, ok := ix.ids[p]
+	if !ok {
+		id = len(ix.ids)
+		ix.ids[p] = id
+		ix.n.Store(int32(len(ix.ids)))
+	}
+	return id
+}
+
+// len returns the number of paths having an id.
+func (ix *pathIndex) len() int {
+	return int(ix.n.Load())
+}
+
+// extraction holds the lookup results of an event by path id. Handlers run
+// concurrently by the worker pool share it, so a slot is claimed before being
+// stored; a handler losing the race walks the path itself. Paths given an id
+// after the extraction was created are not cached.
+type extraction struct {
+	results []extracted
+}
+
+const (
+	slotEmpty int32 = iota
+	slotStoring
+	slotStored
+)
+
+type extracted struct {
+	state atomic.Int32
+	v     interface{}
+	found bool
+}
+
+var extractionPool sync.Pool
+
+// newExtraction returns an empty extraction for n paths. It must be released
+// once every handler of the event returned.
+func newExtraction(n int) *extraction {
+	x, _ := extractionPool.Get().(*extraction)
+	if x == nil {
+		x = &extraction{}
+	}
+	if cap(x.results) < n {
+		x.results = make([]extracted, n)
+	}
+	x.results = x.results[:n]
+	return x
+}
+
+func (x *extraction) release() {
+	clear(x.results)
+	extractionPool.Put(x)
+}
+
+func (x *extraction) get(id int) (interface{}, bool, bool) {
+	if id < 0 || id >= len(x.results) {
+		return nil, false, false
+	}
+	r := &x.results[id]
+	if r.state.Load() != slotStored {
+		return nil, false, false
+	}
+	return r.v, r.found, true
+}
+
+func (x *extraction) put(id int, v interface{}, found bool) {
+	if id < 0 || id >= len(x.results) {
+		return
+	}
+	r := &x.results[id]
+	if r.state.CompareAndSwap(slotEmpty, slotStoring) {
+		r.v, r.found = v, found
+		r.state.Store(slotStored)
+	}
+}
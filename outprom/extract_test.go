@@ -0,0 +1,133 @@
+package outprom
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/yosisa/fluxion/message"
+)
+
+func sharedLabelPlugin(t testing.TB, n int) *OutPrometheus {
+	t.Helper()
+	metrics := make(map[string]Metric, n)
+	for i := 0; i < n; i++ {
+		metrics[fmt.Sprintf("m%d", i)] = decodeMetric(t, `
+type = "counter"
+value = "bytes"
+labels = { vhost = "req/vhost", status = "res/status", method = "req/method" }
+`)
+	}
+	return newTestPlugin(t, metrics)
+}
+
+func sharedLabelEvent() *message.Event {
+	return &message.Event{Tag: "access", Record: map[string]interface{}{
+		"bytes": 512.0,
+		"req":   map[string]interface{}{"vhost": "example.com", "method": "GET"},
+		"res":   map[string]interface{}{"status": "200"},
+	}}
+}
+
+// TestExtractionPerDispatch checks that the lookups cached for one dispatch
+// are not seen by the next dispatch of the same event.
+func TestExtractionPerDispatch(t *testing.T) {
+	p := sharedLabelPlugin(t, 2)
+	ev := sharedLabelEvent()
+	if _, err := p.Encode(ev); err != nil {
+		t.Fatal(err)
+	}
+	ev.Record["req"] = map[string]interface{}{"vhost": "other.example.com", "method": "GET"}
+	if _, err := p.Encode(ev); err != nil {
+		t.Fatal(err)
+	}
+	c := p.loadHandlers()[0].(*Counter)
+	if n := testutilCount(c.CounterVec); n != 2 {
+		t.Errorf("%d series, want 2", n)
+	}
+}
+
+// TestExtractionSlots checks that the first stored lookup of a path wins and
+// that paths indexed after the extraction was created are not cached.
+func TestExtractionSlots(t *testing.T) {
+	x := newExtraction(2)
+	x.put(1, "a", true)
+	x.put(1, "b", true)
+	if v, found, ok := x.get(1); !ok || !found || v != "a" {
+		t.Errorf("get(1) = %v, %v, %v, want a, true, true", v, found, ok)
+	}
+	if _, _, ok := x.get(0); ok {
+		t.Error("get(0) hit before put")
+	}
+	x.put(2, "c", true)
+	if _, _, ok := x.get(2); ok {
+		t.Error("get(2) hit beyond the extraction")
+	}
+	x.release()
+	x = newExtraction(2)
+	defer x.release()
+	if _, _, ok := x.get(1); ok {
+		t.Error("get(1) hit after release")
+	}
+}
+
+func testutilCount(c prometheus.Collector) int {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+	n := 0
+	for range ch {
+		n++
+	}
+	return n
+}
+
+// BenchmarkSharedLabels measures 10 metrics labelled by the same 3 paths,
+// with and without sharing the lookups between them.
+func BenchmarkSharedLabels(b *testing.B) {
+	for _, shared := range []bool{false, true} {
+		b.Run(fmt.Sprintf("shared=%v", shared), func(b *testing.B) {
+			p := sharedLabelPlugin(b, 10)
+			handlers := p.loadHandlers()
+			ev := sharedLabelEvent()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				x := &jsonExpander{ev: event{Event: ev}}
+				if shared {
+					x.ev.x = newExtraction(p.stats.paths.len())
+				}
+				for _, h := range handlers {
+					p.process(h, x)
+				}
+				if shared {
+					x.ev.x.release()
+				}
+			}
+		})
+	}
+}
+
+func TestConsumedStats(t *testing.T) {
+	p := sharedLabelPlugin(t, 2)
+	for i := 0; i < 3; i++ {
+		if _, err := p.Encode(sharedLabelEvent()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"m0", "m1"} {
+		if got := testutil.ToFloat64(p.stats.metricEvents.WithLabelValues(name)); got != 3 {
+			t.Errorf("%s consumed %v events, want 3", name, got)
+		}
+	}
+	// Both handlers and the plugin record the same time for an event.
+	last := testutil.ToFloat64(p.stats.lastEvent)
+	for _, name := range []string{"m0", "m1"} {
+		if got := testutil.ToFloat64(p.stats.metricLastEvent.WithLabelValues(name)); got != last {
+			t.Errorf("%s last event at %v, want %v", name, got, last)
+		}
+	}
+}
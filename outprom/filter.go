@@ -0,0 +1,119 @@
+package outprom
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Filter is a condition on a record field. Numeric operators compare the field
+// as a number, while eq and ne compare it as a string if the operand is a
+// string.
+type Filter struct {
+	Path  string
+	Op    string
+	Value interface{}
+	re    *regexp.Regexp
+	num   float64
+	str   string
+	isStr bool
+	want  bool // whether exists requires the field to be present
+}
+
+func (f *Filter) compile() error {
+	switch f.Op {
+	case "exists":
+		f.want = true
+		if f.Value != nil {
+			b, ok := f.Value.(bool)
+			if !ok {
+				return fmt.Errorf("Operand of exists must be a boolean: %v", f.Value)
+			}
+			f.want = b
+		}
+	case "regex":
+		s, ok := f.Value.(string)
+		if !ok {
+			return fmt.Errorf("Operand of regex must be a string: %v", f.Value)
+		}
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return fmt.Errorf("Invalid regex %q: %v", s, err)
+		}
+		f.re = re
+	case "eq", "ne":
+		if f.str, f.isStr = f.Value.(string); f.isStr {
+			break
+		}
+		fallthrough
+	case "gt", "ge", "lt", "le":
+		n, ok := toFloat(f.Value)
+		if !ok {
+			return fmt.Errorf("Operand of %s must be a number: %v", f.Op, f.Value)
+		}
+		f.num = n
+	default:
+		return fmt.Errorf("Unknown filter operator: %s", f.Op)
+	}
+	return nil
+}
+
+// match reports whether the value at the path satisfies the condition. A
+// missing or non-comparable value never matches except for exists = false.
+func (f *Filter) match(raw interface{}, found bool) bool {
+	if f.Op == "exists" {
+		return found == f.want
+	}
+	if !found {
+		return false
+	}
+	if f.re != nil || f.isStr {
+		s, ok := toString(raw)
+		if !ok {
+			return false
+		}
+		switch f.Op {
+		case "regex":
+			return f.re.MatchString(s)
+		case "eq":
+			return s == f.str
+		}
+		return s != f.str
+	}
+	v, ok := toFloat(raw)
+	if !ok {
+		return false
+	}
+	return compare(CountMode(f.Op), v, f.num)
+}
+
+// compileFilters returns the filters compiled. They are copied so that the
+// config they come from stays as parsed; its fingerprint tells on reload
+// whether the metric changed.
+func compileFilters(filters []Filter) ([]Filter, error) {
+	if len(filters) == 0 {
+		return filters, nil
+	}
+	compiled := append([]Filter(nil), filters...)
+	for i := range compiled {
+		if err := compiled[i].compile(); err != nil {
+			return nil, err
+		}
+	}
+	return compiled, nil
+}
+
+// matchFilters reports whether the event satisfies all the filters, or any of
+// them if any is true. No filters always match.
+func (m *Metric) matchFilters(ev *event, filters []Filter, any bool) bool {
+	if len(filters) == 0 {
+		return true
+	}
+	for i := range filters {
+		raw, found, err := m.lookup(ev, filters[i].Path)
+		ok := err == nil && filters[i].match(raw, found)
+		if ok == any {
+			return ok
+		}
+	}
+	return !any
+}
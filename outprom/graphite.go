@@ -0,0 +1,63 @@
+package outprom
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/graphite"
+)
+
+const (
+	defaultGraphiteInterval = 15 * time.Second
+	graphiteMinBackoff      = time.Second
+	graphiteLogInterval     = time.Minute
+)
+
+// startGraphite starts mirroring the registry to Graphite periodically. A
+// failed push is retried with exponential backoff up to the interval, and
+// failures are logged at most once per minute.
+func (p *OutPrometheus) startGraphite() error {
+	interval := p.conf.GraphiteInterval.Duration
+	if interval == 0 {
+		interval = defaultGraphiteInterval
+	}
+	bridge, err := graphite.NewBridge(&graphite.Config{
+		URL:           p.conf.GraphiteAddress,
+		Prefix:        p.conf.GraphitePrefix,
+		Interval:      interval,
+		Gatherer:      p.registry,
+		ErrorHandling: graphite.ContinueOnError,
+	})
+	if err != nil {
+		return err
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		var lastLogged time.Time
+		backoff := graphiteMinBackoff
+		timer := time.NewTimer(interval)
+		defer timer.Stop()
+		for {
+			select {
+			case <-timer.C:
+			case <-p.stop:
+				return
+			}
+			next := interval
+			if err := bridge.Push(); err != nil {
+				if time.Since(lastLogged) >= graphiteLogInterval {
+					p.env.Log.Errorf("Failed to push metrics to Graphite: %v", err)
+					lastLogged = time.Now()
+				}
+				next = backoff
+				if backoff *= 2; backoff > interval {
+					backoff = interval
+				}
+			} else {
+				backoff = graphiteMinBackoff
+			}
+			timer.Reset(next)
+		}
+	}()
+	return nil
+}
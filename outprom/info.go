@@ -0,0 +1,84 @@
+package outprom
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Info is a gauge fixed at 1 whose labels carry metadata. The labels listed
+// in identity identify the subject; when the other labels of a subject change,
+// the series of the previous values is deleted so that a single series is
+// active per subject. Without identity, the metric has a single subject.
+type Info struct {
+	Metric
+	*prometheus.GaugeVec
+	identity []int
+	mu       sync.Mutex
+	current  map[string][]string
+}
+
+func newInfo(name string, m *Metric, reg prometheus.Registerer) (*Info, error) {
+	if !m.Value.isEmpty() || m.ValueExpr != "" {
+		return nil, fmt.Errorf("Info metric %s cannot have a value", name)
+	}
+	i := &Info{Metric: *m, current: make(map[string][]string)}
+	for _, key := range m.Identity {
+		idx := -1
+		for j, k := range m.labelKeys {
+			if k == key {
+				idx = j
+			}
+		}
+		if idx < 0 {
+			return nil, fmt.Errorf("Identity label %s of %s is not defined in labels", key, name)
+		}
+		i.identity = append(i.identity, idx)
+	}
+	i.GaugeVec = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: m.Help, ConstLabels: m.ConstLabels, Unit: m.Unit}, m.labelKeys)
+	if err := reg.Register(i.GaugeVec); err != nil {
+		return nil, err
+	}
+	if m.expirer != nil {
+		m.expirer.forget = append(m.expirer.forget, i.forget)
+	}
+	return i, nil
+}
+
+func (i *Info) identityKey(lvals []string) string {
+	id := make([]string, len(i.identity))
+	for j, idx := range i.identity {
+		id[j] = lvals[idx]
+	}
+	return seriesKey(id)
+}
+
+func (i *Info) HandleEvent(ev *event) error {
+	s := i.scratch()
+	defer i.release(s)
+	lvals, err := i.labelValues(ev, "", s)
+	if err != nil {
+		return err
+	}
+	id := i.identityKey(lvals)
+	i.mu.Lock()
+	if prev, ok := i.current[id]; ok && seriesKey(prev) != seriesKey(lvals) {
+		i.GaugeVec.DeleteLabelValues(prev...)
+	}
+	i.current[id] = append([]string(nil), lvals...)
+	i.mu.Unlock()
+	i.WithLabelValues(lvals...).Set(1)
+	return nil
+}
+
+// forget drops the subject of the series expired by the TTL.
+func (i *Info) forget(key string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for id, lvals := range i.current {
+		if seriesKey(lvals) == key {
+			delete(i.current, id)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package outprom
+
+import (
+	"fmt"
+	"sort"
+)
+
+// initialSeries returns the label values of the series to create up front,
+// from initial_label_values and the cartesian product of initial_labels. The
+// values are in the order of keys.
+func (m *Metric) initialSeries(keys []string) ([][]string, error) {
+	var series [][]string
+	for _, lvals := range m.InitialLabelValues {
+		if len(lvals) != len(keys) {
+			return nil, fmt.Errorf("initial_label_values %v must have %d values for labels %v", lvals, len(keys), keys)
+		}
+		series = append(series, lvals)
+	}
+	if len(m.InitialLabels) > 0 {
+		for key := range m.InitialLabels {
+			if i := sort.SearchStrings(keys, key); i == len(keys) || keys[i] != key {
+				return nil, fmt.Errorf("Unknown label of initial_labels: %s", key)
+			}
+		}
+		product := [][]string{{}}
+		for _, key := range keys {
+			values, ok := m.InitialLabels[key]
+			if !ok || len(values) == 0 {
+				return nil, fmt.Errorf("initial_labels must list the values of label %s", key)
+			}
+			next := make([][]string, 0, len(product)*len(values))
+			for _, p := range product {
+				for _, v := range values {
+					lvals := make([]string, len(p), len(keys))
+					copy(lvals, p)
+					next = append(next, append(lvals, v))
+				}
+			}
+			product = next
+		}
+		series = append(series, product...)
+	}
+	seen := make(map[string]bool, len(series))
+	for _, lvals := range series {
+		key := seriesKey(lvals)
+		if seen[key] {
+			return nil, fmt.Errorf("Duplicate initial label values: %v", lvals)
+		}
+		seen[key] = true
+	}
+	return series, nil
+}
+
+// initSeries creates the series of the label values with no observation.
+// Unless keep_initial_series is set, they expire per ttl like the others.
+func (m *Metric) initSeries(h Handler, series [][]string) error {
+	for _, lvals := range series {
+		if m.limiter != nil {
+			if m.OverflowAction == "fold" {
+				lvals = append(lvals[:len(lvals):len(lvals)], "")
+			}
+			var ok bool
+			if lvals, ok = m.limiter.admit(lvals); !ok {
+				continue
+			}
+		}
+		switch v := h.(type) {
+		case *Gauge:
+			v.child(lvals).Add(0)
+		case *Counter:
+			v.child(lvals).Add(0)
+		case *Histogram:
+			v.WithLabelValues(lvals...)
+		case *Summary:
+			v.WithLabelValues(lvals...)
+		default:
+			return fmt.Errorf("Initial series are not supported by %s", m.Type)
+		}
+		if m.expirer != nil && !m.KeepInitialSeries {
+			m.expirer.touch(lvals)
+		}
+	}
+	return nil
+}
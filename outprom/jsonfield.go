@@ -0,0 +1,88 @@
+package outprom
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// jsonExpander expands the JSON-encoded fields of an event for the handlers
+// having json_fields. Every field is parsed at most once per event into a
+// copy of the record, leaving the event itself untouched. It is safe for
+// concurrent use; a returned event is never modified afterwards.
+type jsonExpander struct {
+	mu       sync.Mutex
+	ev       event
+	expanded *event
+	done     map[string]error
+	// now is the time the event was received, read once for all handlers.
+	now time.Time
+}
+
+// expand returns the event with the fields parsed. The parse error of a field
+// is returned to the first handler referring to it; later ones get errSkip.
+func (x *jsonExpander) expand(fields []string) (*event, error) {
+	if len(fields) == 0 {
+		return &x.ev, nil
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.done == nil {
+		x.done = make(map[string]error)
+	}
+	var first error
+	for _, f := range fields {
+		err, ok := x.done[f]
+		if ok {
+			if err != nil {
+				err = errSkip
+			}
+		} else {
+			err = x.parse(f)
+			x.done[f] = err
+		}
+		if err != nil && (first == nil || first == errSkip) {
+			first = err
+		}
+	}
+	if first != nil {
+		return nil, first
+	}
+	if x.expanded == nil {
+		return &x.ev, nil
+	}
+	return x.expanded, nil
+}
+
+func (x *jsonExpander) parse(field string) error {
+	var b []byte
+	switch v := x.ev.Record[field].(type) {
+	case string:
+		b = []byte(v)
+	case []byte:
+		b = v
+	default:
+		return nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return &handlerError{errParse, fmt.Errorf("%s: %v", field, err)}
+	}
+	// The record is copied for every parsed field, as the previous copy may
+	// be in use by a handler already.
+	base := x.ev.Event
+	if x.expanded != nil {
+		base = x.expanded.Event
+	}
+	record := make(map[string]interface{}, len(base.Record))
+	for k, v := range base.Record {
+		record[k] = v
+	}
+	record[field] = v
+	ev := *base
+	ev.Record = record
+	// The lookups shared by the handlers are of the original record.
+	x.expanded = &event{Event: &ev}
+	return nil
+}
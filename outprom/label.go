@@ -0,0 +1,326 @@
+package outprom
+
+import (
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// sanitizeLabel replaces invalid UTF-8 sequences and turns control characters
+// into spaces so that a label value stays on a single readable line. With
+// collapse, runs of whitespace become a single space and leading and trailing
+// whitespace is removed.
+func sanitizeLabel(s string, collapse bool) string {
+	if isCleanLabel(s, collapse) {
+		return s
+	}
+	var b strings.Builder
+	space := false
+	for _, r := range strings.ToValidUTF8(s, string(utf8.RuneError)) {
+		if !collapse {
+			if unicode.IsControl(r) {
+				r = ' '
+			}
+			b.WriteRune(r)
+			continue
+		}
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			space = true
+			continue
+		}
+		if space && b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		space = false
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// isCleanLabel reports whether sanitizeLabel would return s unchanged.
+func isCleanLabel(s string, collapse bool) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+	for i, r := range s {
+		if unicode.IsControl(r) {
+			return false
+		}
+		if collapse && unicode.IsSpace(r) && (r != ' ' || i == 0 || i == len(s)-1 || s[i-1] == ' ') {
+			return false
+		}
+	}
+	return true
+}
+
+// truncateLabel shortens s to at most n bytes. A hash of the whole value is
+// appended so that distinct long values remain distinct.
+func truncateLabel(s string, n int) string {
+	if n <= 0 || len(s) <= n {
+		return s
+	}
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	suffix := fmt.Sprintf("~%08x", h.Sum32())
+	cut := n - len(suffix)
+	if cut < 0 {
+		return suffix[len(suffix)-n:]
+	}
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut] + suffix
+}
+
+// LabelSource is the record path of a label, given either as a string or as
+// a table such as { path = "vhost", default = "unknown", lowercase = true }.
+type LabelSource struct {
+	Path string
+	// Candidates are the paths tried in order if path is given as a list.
+	Candidates []string
+	Default    *string
+	Lowercase  bool
+	Uppercase  bool
+	Trim       bool
+	Replace    []Replacement
+	Map        map[string]string
+	Allow      []string
+	Fallback   *string
+}
+
+// Replacement substitutes To for From. From is a regular expression whose
+// groups can be referred to as $1 in To if Regex is true.
+type Replacement struct {
+	From  string
+	To    string
+	Regex bool
+}
+
+func (s *LabelSource) UnmarshalTOML(v interface{}) error {
+	switch t := v.(type) {
+	case string:
+		s.Path = t
+		return nil
+	case []interface{}:
+		var err error
+		s.Path, s.Candidates, err = tomlPaths("label", t)
+		return err
+	case map[string]interface{}:
+		for k, x := range t {
+			var err error
+			switch k {
+			case "path":
+				if a, ok := x.([]interface{}); ok {
+					s.Path, s.Candidates, err = tomlPaths(k, a)
+				} else {
+					err = tomlString(k, x, &s.Path)
+				}
+			case "default":
+				var str string
+				err = tomlString(k, x, &str)
+				s.Default = &str
+			case "lowercase":
+				err = tomlBool(k, x, &s.Lowercase)
+			case "uppercase":
+				err = tomlBool(k, x, &s.Uppercase)
+			case "trim":
+				err = tomlBool(k, x, &s.Trim)
+			case "replace":
+				err = s.unmarshalReplace(x)
+			case "map":
+				err = s.unmarshalMap(x)
+			case "allow":
+				err = s.unmarshalAllow(x)
+			case "fallback":
+				var str string
+				err = tomlString(k, x, &str)
+				s.Fallback = &str
+			default:
+				err = fmt.Errorf("Unknown key of label: %s", k)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if s.Path == "" {
+			return fmt.Errorf("path of label is required")
+		}
+		return nil
+	}
+	return fmt.Errorf("Label must be a string or a table: %v", v)
+}
+
+func (s *LabelSource) unmarshalReplace(v interface{}) error {
+	var list []interface{}
+	switch t := v.(type) {
+	case []interface{}:
+		list = t
+	case []map[string]interface{}:
+		for _, x := range t {
+			list = append(list, x)
+		}
+	case map[string]interface{}:
+		list = []interface{}{t}
+	default:
+		return fmt.Errorf("replace of label must be a table or an array of tables: %v", v)
+	}
+	for _, x := range list {
+		t, ok := x.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("replace of label must be a table or an array of tables: %v", v)
+		}
+		var r Replacement
+		for k, y := range t {
+			var err error
+			switch k {
+			case "from":
+				err = tomlString(k, y, &r.From)
+			case "to":
+				err = tomlString(k, y, &r.To)
+			case "regex":
+				err = tomlBool(k, y, &r.Regex)
+			default:
+				err = fmt.Errorf("Unknown key of replace: %s", k)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if r.From == "" {
+			return fmt.Errorf("from of replace is required")
+		}
+		s.Replace = append(s.Replace, r)
+	}
+	return nil
+}
+
+func (s *LabelSource) unmarshalMap(v interface{}) error {
+	t, ok := v.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("map of label must be a table: %v", v)
+	}
+	s.Map = make(map[string]string, len(t))
+	for k, x := range t {
+		str, ok := x.(string)
+		if !ok {
+			return fmt.Errorf("Value of map must be a string: %v", x)
+		}
+		s.Map[k] = str
+	}
+	return nil
+}
+
+func (s *LabelSource) unmarshalAllow(v interface{}) error {
+	list, ok := v.([]interface{})
+	if !ok {
+		return fmt.Errorf("allow of label must be an array: %v", v)
+	}
+	for _, x := range list {
+		var str string
+		if err := tomlString("allow", x, &str); err != nil {
+			return err
+		}
+		s.Allow = append(s.Allow, str)
+	}
+	return nil
+}
+
+// pipeline compiles the transforms of the label in the order of trim,
+// lowercase or uppercase, replacements, map and allow. A value not in allow
+// becomes fallback, which is "other" by default.
+func (s LabelSource) pipeline() ([]func(string) string, error) {
+	var fs []func(string) string
+	if s.Trim {
+		fs = append(fs, strings.TrimSpace)
+	}
+	if s.Lowercase && s.Uppercase {
+		return nil, fmt.Errorf("lowercase and uppercase are exclusive")
+	}
+	if s.Lowercase {
+		fs = append(fs, strings.ToLower)
+	}
+	if s.Uppercase {
+		fs = append(fs, strings.ToUpper)
+	}
+	for _, r := range s.Replace {
+		r := r
+		if !r.Regex {
+			fs = append(fs, func(v string) string { return strings.Replace(v, r.From, r.To, -1) })
+			continue
+		}
+		re, err := regexp.Compile(r.From)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid regex %q: %v", r.From, err)
+		}
+		fs = append(fs, func(v string) string { return re.ReplaceAllString(v, r.To) })
+	}
+	if len(s.Map) > 0 {
+		m := s.Map
+		fs = append(fs, func(v string) string {
+			if to, ok := m[v]; ok {
+				return to
+			}
+			return v
+		})
+	}
+	if s.Fallback != nil && len(s.Allow) == 0 {
+		return nil, fmt.Errorf("fallback requires allow")
+	}
+	if len(s.Allow) > 0 {
+		allow := make(map[string]struct{}, len(s.Allow))
+		for _, a := range s.Allow {
+			allow[a] = struct{}{}
+		}
+		fallback := "other"
+		if s.Fallback != nil {
+			fallback = *s.Fallback
+		}
+		fs = append(fs, func(v string) string {
+			if _, ok := allow[v]; ok {
+				return v
+			}
+			return fallback
+		})
+	}
+	return fs, nil
+}
+
+func tomlString(key string, v interface{}, dst *string) error {
+	s, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("%s must be a string: %v", key, v)
+	}
+	*dst = s
+	return nil
+}
+
+// tomlPaths reads a list of fallback paths. The paths joined with " | " are
+// returned as the path referring to the list, along with the list itself if
+// it has more than one path.
+func tomlPaths(key string, v []interface{}) (string, []string, error) {
+	paths := make([]string, len(v))
+	for i, x := range v {
+		if err := tomlString(key, x, &paths[i]); err != nil {
+			return "", nil, err
+		}
+	}
+	switch len(paths) {
+	case 0:
+		return "", nil, fmt.Errorf("%s must have at least one path", key)
+	case 1:
+		return paths[0], nil, nil
+	}
+	return strings.Join(paths, " | "), paths, nil
+}
+
+func tomlBool(key string, v interface{}, dst *bool) error {
+	b, ok := v.(bool)
+	if !ok {
+		return fmt.Errorf("%s must be a boolean: %v", key, v)
+	}
+	*dst = b
+	return nil
+}
@@ -0,0 +1,158 @@
+package outprom
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+func TestSanitizeLabel(t *testing.T) {
+	tests := []struct {
+		in, collapsed, kept string
+	}{
+		{"plain", "plain", "plain"},
+		{"a b", "a b", "a b"},
+		{" a", "a", " a"},
+		{"a ", "a", "a "},
+		{"a  b", "a b", "a  b"},
+		{"a\nb", "a b", "a b"},
+		{"a\tb", "a b", "a b"},
+		{"a\u0085b", "a b", "a b"},
+		{"a\u009fb", "a b", "a b"},
+		{"a\x7fb", "a b", "a b"},
+		{"a\u2028b", "a b", "a\u2028b"},
+		{"a\xffb", "a\ufffdb", "a\ufffdb"},
+		{"\n", "", " "},
+	}
+	for _, tt := range tests {
+		if got := sanitizeLabel(tt.in, true); got != tt.collapsed {
+			t.Errorf("sanitizeLabel(%q, true) = %q, want %q", tt.in, got, tt.collapsed)
+		}
+		if got := sanitizeLabel(tt.in, false); got != tt.kept {
+			t.Errorf("sanitizeLabel(%q, false) = %q, want %q", tt.in, got, tt.kept)
+		}
+	}
+}
+
+// slowSanitizeLabel is sanitizeLabel without the fast path.
+func slowSanitizeLabel(s string, collapse bool) string {
+	var b strings.Builder
+	space := false
+	for _, r := range strings.ToValidUTF8(s, string(utf8.RuneError)) {
+		if !collapse {
+			if unicode.IsControl(r) {
+				r = ' '
+			}
+			b.WriteRune(r)
+			continue
+		}
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			space = true
+			continue
+		}
+		if space && b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		space = false
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func TestSanitizeLabelFastPath(t *testing.T) {
+	parts := []string{"a", " ", "  ", "\t", "\n", "\u0085", "\u00a0", "\u3000", "\x7f", "\xff", "\ufffd", "é"}
+	for _, x := range parts {
+		for _, y := range parts {
+			for _, z := range parts {
+				s := x + y + z
+				for _, collapse := range []bool{true, false} {
+					if got, want := sanitizeLabel(s, collapse), slowSanitizeLabel(s, collapse); got != want {
+						t.Errorf("sanitizeLabel(%q, %v) = %q, want %q", s, collapse, got, want)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestLabelSyntax(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels string
+		want   LabelSource
+	}{
+		{"string", `vhost = "vhost"`, LabelSource{Path: "vhost"}},
+		{"nested string", `vhost = "req/vhost"`, LabelSource{Path: "req/vhost"}},
+		{"table", `vhost = { path = "vhost" }`, LabelSource{Path: "vhost"}},
+		{"table with default", `vhost = { path = "vhost", default = "unknown" }`, LabelSource{Path: "vhost", Default: strPtr("unknown")}},
+		{"list", `vhost = ["host", "vhost"]`, LabelSource{Path: "host | vhost", Candidates: []string{"host", "vhost"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := decodeMetric(t, "type = \"counter\"\n[metrics.test.labels]\n"+tt.labels+"\n")
+			got := m.Labels["vhost"]
+			if got.Path != tt.want.Path || !equalStrings(got.Candidates, tt.want.Candidates) ||
+				(got.Default == nil) != (tt.want.Default == nil) || got.Default != nil && *got.Default != *tt.want.Default {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func strPtr(s string) *string { return &s }
+
+func TestMissingLabel(t *testing.T) {
+	tests := []struct {
+		name  string
+		conf  string
+		vhost interface{}
+		want  string
+	}{
+		{"string syntax", `labels = { vhost = "vhost" }`, nil, `test{vhost=""} 1`},
+		{"table syntax", `labels = { vhost = { path = "vhost" } }`, nil, `test{vhost=""} 1`},
+		{"label default", `labels = { vhost = { path = "vhost", default = "unknown" } }`, nil, `test{vhost="unknown"} 1`},
+		{"action default", "labels = { vhost = \"vhost\" }\nmissing_label_action = \"default\"\nmissing_label_default = \"none\"", nil, `test{vhost="none"} 1`},
+		{"action drop", "labels = { vhost = \"vhost\" }\nmissing_label_action = \"drop\"", nil, ``},
+		{"present", `labels = { vhost = { path = "vhost", default = "unknown" } }`, "example.com", `test{vhost="example.com"} 1`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, reg := newTestHandler(t, "type = \"counter\"\nvalue = \"n\"\n"+tt.conf)
+			record := map[string]interface{}{"n": 1.0}
+			if tt.vhost != nil {
+				record["vhost"] = tt.vhost
+			}
+			if err := h.HandleEvent(newEvent("t", record)); err != nil && err != errSkip {
+				t.Fatal(err)
+			}
+			assertMetrics(t, reg, tt.want)
+		})
+	}
+}
+
+// TestLabelValuesRetained checks the series kept across events do not share
+// the pooled label values of a later event.
+func TestLabelValuesRetained(t *testing.T) {
+	h, reg := newTestHandler(t, `
+type = "gauge"
+value = "n"
+labels = { path = "path" }
+aggregate = "max"
+`)
+	handle(t, h, newEvent("t", map[string]interface{}{"n": 1.0, "path": "/a"}))
+	handle(t, h, newEvent("t", map[string]interface{}{"n": 2.0, "path": "/b"}))
+	assertMetrics(t, reg, "test{path=\"/a\"} 1\ntest{path=\"/b\"} 2")
+
+	h, reg = newTestHandler(t, `
+type = "counter"
+value = "n"
+labels = { path = "path" }
+ttl = "1h"
+`)
+	handle(t, h, newEvent("t", map[string]interface{}{"n": 1.0, "path": "/a"}))
+	handle(t, h, newEvent("t", map[string]interface{}{"n": 1.0, "path": "/b"}))
+	h.expiry().expire(time.Now().Add(2 * time.Hour))
+	assertMetrics(t, reg, "")
+}
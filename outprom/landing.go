@@ -0,0 +1,100 @@
+package outprom
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+)
+
+var landingTemplate = template.Must(template.New("landing").Parse(`<!DOCTYPE html>
+<html>
+<head><title>fluxion out-prometheus</title></head>
+<body>
+<h1>fluxion out-prometheus</h1>
+<p>{{.Version}}</p>
+<p><a href="{{.Path}}">Metrics</a> &middot; <a href="/-/config">Config</a></p>
+<table>
+<tr><th>Name</th><th>Type</th><th>Help</th></tr>
+{{range .Metrics}}<tr><td>{{.Name}}</td><td>{{.Type}}</td><td>{{.Help}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+type landingMetric struct {
+	Name string
+	Type MetricType
+	Help string
+}
+
+// currentMetrics returns the metrics of the handlers in effect.
+func (p *OutPrometheus) currentMetrics() map[string]Metric {
+	if s, ok := p.handlers.Load().(*handlerSet); ok {
+		return s.metrics
+	}
+	return nil
+}
+
+// landingHandler serves the page at / listing the configured metrics.
+func (p *OutPrometheus) landingHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		var metrics []landingMetric
+		for key, m := range p.currentMetrics() {
+			name := m.fqName(key)
+			metrics = append(metrics, landingMetric{Name: name, Type: m.Type, Help: m.helpText(name)})
+		}
+		sort.Slice(metrics, func(i, j int) bool { return metrics[i].Name < metrics[j].Name })
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		landingTemplate.Execute(w, struct {
+			Version string
+			Path    string
+			Metrics []landingMetric
+		}{VersionString(), p.conf.Path, metrics})
+	})
+}
+
+const redacted = "<redacted>"
+
+// configHandler serves the effective configuration as JSON with the
+// credentials redacted.
+func (p *OutPrometheus) configHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.reloadMu.Lock()
+		conf := p.conf
+		p.reloadMu.Unlock()
+		conf.Metrics = p.currentMetrics()
+		if conf.Password != "" {
+			conf.Password = redacted
+		}
+		if conf.AuthToken != "" {
+			conf.AuthToken = redacted
+		}
+		listeners := make([]Listener, len(conf.Listen.Listeners))
+		for i, l := range conf.Listen.Listeners {
+			if l.Password != "" {
+				l.Password = redacted
+			}
+			if l.AuthToken != "" {
+				l.AuthToken = redacted
+			}
+			listeners[i] = l
+		}
+		conf.Listen.Listeners = listeners
+		if u, err := url.Parse(conf.PushgatewayURL); err == nil && u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				u.User = url.UserPassword(u.User.Username(), redacted)
+				conf.PushgatewayURL = u.String()
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(conf)
+	})
+}
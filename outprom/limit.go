@@ -0,0 +1,75 @@
+package outprom
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type OverflowAction string
+
+func (a *OverflowAction) UnmarshalText(b []byte) error {
+	s := string(b)
+	switch s {
+	case "drop", "fold":
+		*a = OverflowAction(s)
+		return nil
+	}
+	return fmt.Errorf("Unknown overflow action: %s", s)
+}
+
+const overflowLabel = "overflow"
+
+// seriesLimiter bounds the number of distinct label sets of a metric. Once the
+// limit is reached, samples of new label sets are either dropped or folded
+// into a single series labeled overflow="true".
+type seriesLimiter struct {
+	max      int64
+	action   OverflowAction
+	count    int64
+	series   sync.Map
+	overflow []string
+	limited  prometheus.Counter
+}
+
+func newSeriesLimiter(name string, max int, action OverflowAction, nlabels int, st *stats) *seriesLimiter {
+	l := &seriesLimiter{
+		max:     int64(max),
+		action:  action,
+		limited: st.seriesLimited.WithLabelValues(name, string(action)),
+	}
+	if action == "fold" {
+		l.overflow = make([]string, nlabels)
+		l.overflow[nlabels-1] = "true"
+	}
+	return l
+}
+
+// admit returns the label values to be used for the sample, or false if the
+// sample should be dropped.
+func (l *seriesLimiter) admit(lvals []string) ([]string, bool) {
+	key := seriesKey(lvals)
+	if _, ok := l.series.Load(key); ok {
+		return lvals, true
+	}
+	if atomic.AddInt64(&l.count, 1) <= l.max {
+		if _, loaded := l.series.LoadOrStore(key, struct{}{}); loaded {
+			atomic.AddInt64(&l.count, -1)
+		}
+		return lvals, true
+	}
+	atomic.AddInt64(&l.count, -1)
+	l.limited.Inc()
+	if l.action == "fold" {
+		return l.overflow, true
+	}
+	return nil, false
+}
+
+func (l *seriesLimiter) forget(key string) {
+	if _, ok := l.series.LoadAndDelete(key); ok {
+		atomic.AddInt64(&l.count, -1)
+	}
+}
@@ -0,0 +1,44 @@
+package outprom
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/BurntSushi/toml"
+)
+
+// loadMetricsDir merges the metrics defined in the *.toml files of
+// metrics_dir into the inline ones. Each file has [metrics.<name>] tables
+// like the plugin config. A metric defined twice is an error.
+func (c *Config) loadMetricsDir() error {
+	if c.MetricsDir == "" {
+		return nil
+	}
+	files, err := filepath.Glob(filepath.Join(c.MetricsDir, "*.toml"))
+	if err != nil {
+		return err
+	}
+	metrics := make(map[string]Metric, len(c.Metrics))
+	origins := make(map[string]string, len(c.Metrics))
+	for name, m := range c.Metrics {
+		metrics[name] = m
+		origins[name] = "the plugin config"
+	}
+	for _, file := range files {
+		var def struct {
+			Metrics map[string]Metric
+		}
+		if _, err := toml.DecodeFile(file, &def); err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		for name, m := range def.Metrics {
+			if origin, ok := origins[name]; ok {
+				return fmt.Errorf("Metric %s is defined in both %s and %s", name, origin, file)
+			}
+			metrics[name] = m
+			origins[name] = file
+		}
+	}
+	c.Metrics = metrics
+	return nil
+}
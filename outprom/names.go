@@ -0,0 +1,62 @@
+package outprom
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	metricNameRe = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelNameRe  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	unitRe       = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+)
+
+// baseUnits are the units whose suffixes are recognized as conflicting with
+// the unit of a metric.
+var baseUnits = []string{"seconds", "bytes", "ratio", "meters", "grams", "volts", "amperes", "joules", "celsius"}
+
+func validateMetricName(name string) error {
+	if !metricNameRe.MatchString(name) {
+		return fmt.Errorf("Invalid metric name: %q", name)
+	}
+	return nil
+}
+
+// validateLabelName checks that key is a valid label name which is not
+// reserved by Prometheus or the histogram/summary types.
+func validateLabelName(metric, key string) error {
+	if !labelNameRe.MatchString(key) {
+		return fmt.Errorf("Invalid label name of %s: %q", metric, key)
+	}
+	if key == "le" || key == "quantile" || strings.HasPrefix(key, "__") {
+		return fmt.Errorf("Reserved label name of %s: %q", metric, key)
+	}
+	return nil
+}
+
+// checkNaming checks that the unit of the metric is valid and the name does
+// not end with the suffix of another unit.
+func (m *Metric) checkNaming(name string) error {
+	if m.Unit == "" {
+		return nil
+	}
+	if !unitRe.MatchString(m.Unit) {
+		return fmt.Errorf("Invalid unit of %s: %q", name, m.Unit)
+	}
+	base := strings.TrimSuffix(name, "_total")
+	for _, u := range baseUnits {
+		if u != m.Unit && strings.HasSuffix(base, "_"+u) {
+			return fmt.Errorf("Metric %s has the suffix of unit %s which conflicts with unit = %q", name, u, m.Unit)
+		}
+	}
+	return nil
+}
+
+// newDesc returns the descriptor of a collector of the metric, carrying the
+// unit for the OpenMetrics UNIT metadata.
+func (m *Metric) newDesc(name string, labels []string) *prometheus.Desc {
+	return prometheus.V2.NewDesc(name, m.Help, prometheus.UnconstrainedLabels(labels), m.ConstLabels, prometheus.WithUnit(m.Unit))
+}
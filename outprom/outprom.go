@@ -0,0 +1,2171 @@
+package outprom
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/yosisa/fluxion/buffer"
+	"github.com/yosisa/fluxion/message"
+	"github.com/yosisa/fluxion/plugin"
+)
+
+// errSkip is returned by a handler when the event is intentionally ignored.
+var errSkip = errors.New("skip")
+
+// Kinds of errors returned by handlers.
+const (
+	errScan            = "scan"
+	errTypeMismatch    = "type_mismatch"
+	errNegativeCounter = "negative_counter"
+	errUnknownValue    = "unknown_value"
+	errParse           = "parse"
+	errMissing         = "missing"
+	errMisaligned      = "misaligned"
+	errNonMonotonic    = "non_monotonic"
+	errNonFinite       = "non_finite"
+	errOutOfBounds     = "out_of_bounds"
+)
+
+type handlerError struct {
+	kind string
+	err  error
+}
+
+func (e *handlerError) Error() string {
+	return e.err.Error()
+}
+
+func errorKind(err error) string {
+	if e, ok := err.(*handlerError); ok {
+		return e.kind
+	}
+	return "other"
+}
+
+type MetricType string
+
+func (t *MetricType) UnmarshalText(b []byte) error {
+	s := string(b)
+	switch s {
+	case "gauge", "counter", "histogram", "summary", "rate", "distinct", "info", "enum", "percentiles":
+		*t = MetricType(s)
+		return nil
+	}
+	return fmt.Errorf("Unknown metric type: %s", s)
+}
+
+type CountMode string
+
+func (m *CountMode) UnmarshalText(b []byte) error {
+	s := string(b)
+	switch s {
+	case "value", "exist", "non_exist", "delta", "match", "not_match",
+		"gt", "ge", "lt", "le", "eq", "ne":
+		*m = CountMode(s)
+		return nil
+	}
+	return fmt.Errorf("Unknown count mode: %s", s)
+}
+
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(b []byte) (err error) {
+	d.Duration, err = time.ParseDuration(string(b))
+	return
+}
+
+var defaultObjectives = map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001}
+
+type ValueFormat string
+
+func (f *ValueFormat) UnmarshalText(b []byte) error {
+	s := string(b)
+	switch {
+	case s == "duration", s == "bytes", s == "time", strings.HasPrefix(s, "time:") && len(s) > len("time:"):
+		*f = ValueFormat(s)
+		return nil
+	}
+	return fmt.Errorf("Unknown value format: %s", s)
+}
+
+// ValuePath is the path of the metric value. It is either a single path, or a
+// table of label value to path where each path produces a series labeled by
+// value_label.
+type ValuePath struct {
+	Path  string
+	Paths map[string]string
+	// Candidates are the paths tried in order if the value is given as a
+	// list.
+	Candidates []string
+}
+
+func (p *ValuePath) UnmarshalTOML(data interface{}) error {
+	switch d := data.(type) {
+	case string:
+		p.Path = d
+		return nil
+	case []interface{}:
+		var err error
+		p.Path, p.Candidates, err = tomlPaths("value", d)
+		return err
+	case map[string]interface{}:
+		p.Paths = make(map[string]string)
+		for k, v := range d {
+			s, ok := v.(string)
+			if !ok {
+				return fmt.Errorf("Path of value %s must be a string", k)
+			}
+			p.Paths[k] = s
+		}
+		return nil
+	}
+	return fmt.Errorf("Value must be a path, a list of paths or a table of paths: %v", data)
+}
+
+func (p ValuePath) isEmpty() bool {
+	return p.Path == "" && p.Paths == nil
+}
+
+type ArrayMode string
+
+func (m *ArrayMode) UnmarshalText(b []byte) error {
+	s := string(b)
+	switch s {
+	case "each", "sum", "min", "max", "avg", "len":
+		*m = ArrayMode(s)
+		return nil
+	}
+	return fmt.Errorf("Unknown array mode: %s", s)
+}
+
+type DivisionByZero string
+
+func (d *DivisionByZero) UnmarshalText(b []byte) error {
+	s := string(b)
+	switch s {
+	case "skip", "zero":
+		*d = DivisionByZero(s)
+		return nil
+	}
+	return fmt.Errorf("Unknown division_by_zero: %s", s)
+}
+
+type FilterMode string
+
+func (m *FilterMode) UnmarshalText(b []byte) error {
+	s := string(b)
+	switch s {
+	case "all", "any":
+		*m = FilterMode(s)
+		return nil
+	}
+	return fmt.Errorf("Unknown filter mode: %s", s)
+}
+
+type MissingAction string
+
+func (a *MissingAction) UnmarshalText(b []byte) error {
+	s := string(b)
+	switch s {
+	case "skip", "default", "error":
+		*a = MissingAction(s)
+		return nil
+	}
+	return fmt.Errorf("Unknown missing action: %s", s)
+}
+
+type MissingLabelAction string
+
+func (a *MissingLabelAction) UnmarshalText(b []byte) error {
+	s := string(b)
+	switch s {
+	case "empty", "default", "drop":
+		*a = MissingLabelAction(s)
+		return nil
+	}
+	return fmt.Errorf("Unknown missing label action: %s", s)
+}
+
+type NonFiniteAction string
+
+func (a *NonFiniteAction) UnmarshalText(b []byte) error {
+	s := string(b)
+	switch s {
+	case "skip", "zero", "error", "pass":
+		*a = NonFiniteAction(s)
+		return nil
+	}
+	return fmt.Errorf("Unknown non-finite action: %s", s)
+}
+
+type ErrorPolicy string
+
+func (p *ErrorPolicy) UnmarshalText(b []byte) error {
+	s := string(b)
+	switch s {
+	case "log", "drop_silent", "fail":
+		*p = ErrorPolicy(s)
+		return nil
+	}
+	return fmt.Errorf("Unknown error policy: %s", s)
+}
+
+type Handler interface {
+	prometheus.Collector
+	DeleteLabelValues(...string) bool
+	MatchTag(string) bool
+	exactTag() (string, bool)
+	MatchRecord(*event) bool
+	tombstone(*event) (bool, error)
+	sample() bool
+	jsonFields() []string
+	HandleEvent(*event) error
+	metricName() string
+	errorPolicy() ErrorPolicy
+	expiry() *seriesExpirer
+	unmatchedPaths() []string
+	// consumed records in the statistics that the handler consumed an event
+	// at now.
+	consumed(now time.Time)
+	// Start is called before the handler receives events. Goroutines of the
+	// handler must stop when ctx is done or Close is called.
+	Start(ctx context.Context) error
+	// Close releases the handler, returning after its goroutines stopped.
+	Close() error
+}
+
+type Config struct {
+	Listen                ListenConfig
+	SocketMode            string    `toml:"socket_mode"`
+	SocketActivation      bool      `toml:"socket_activation"`
+	BindRetry             BindRetry `toml:"bind_retry"`
+	PortFile              string    `toml:"port_file"`
+	AdminAPI              bool      `toml:"admin_api"`
+	MetricsDir            string    `toml:"metrics_dir"`
+	StrictEnv             bool      `toml:"strict_env"`
+	BuiltinTagCounter     bool      `toml:"builtin_tag_counter"`
+	TagCounterDepth       int       `toml:"tag_counter_depth"`
+	TagCounterMaxTags     int       `toml:"tag_counter_max_tags"`
+	TagCounterOtherTag    string    `toml:"tag_counter_other_tag"`
+	StateFile             string    `toml:"state_file"`
+	StateInterval         Duration  `toml:"state_interval"`
+	Workers               int
+	QueueSize             int             `toml:"queue_size"`
+	QueueFullAction       QueueFullAction `toml:"queue_full_action"`
+	LogThrottleInterval   Duration        `toml:"log_throttle_interval"`
+	Path                  string
+	ShutdownTimeout       Duration `toml:"shutdown_timeout"`
+	PushgatewayURL        string   `toml:"pushgateway_url"`
+	Job                   string
+	Grouping              map[string]string
+	PushInterval          Duration `toml:"push_interval"`
+	GraphiteAddress       string   `toml:"graphite_address"`
+	GraphitePrefix        string   `toml:"graphite_prefix"`
+	GraphiteInterval      Duration `toml:"graphite_interval"`
+	TextfilePath          string   `toml:"textfile_path"`
+	TextfileInterval      Duration `toml:"textfile_interval"`
+	TLSCert               string   `toml:"tls_cert"`
+	TLSKey                string   `toml:"tls_key"`
+	TLSClientCA           string   `toml:"tls_client_ca"`
+	Username              string
+	Password              string
+	AuthToken             string             `toml:"auth_token"`
+	OpenMetrics           bool               `toml:"open_metrics"`
+	AllowCIDRs            []string           `toml:"allow_cidrs"`
+	TrustProxyHeader      bool               `toml:"trust_proxy_header"`
+	ErrorHandling         ErrorHandling      `toml:"error_handling"`
+	MaxRequestsInFlight   int                `toml:"max_requests_in_flight"`
+	ScrapeTimeout         Duration           `toml:"scrape_timeout"`
+	DisableCompression    bool               `toml:"disable_compression"`
+	MaxEventSilence       Duration           `toml:"max_event_silence"`
+	IncludeGoMetrics      bool               `toml:"include_go_metrics"`
+	CollectGoMetrics      bool               `toml:"collect_go_metrics"`
+	CollectProcessMetrics bool               `toml:"collect_process_metrics"`
+	MissingLabelAction    MissingLabelAction `toml:"missing_label_action"`
+	MissingLabelDefault   string             `toml:"missing_label_default"`
+	SanitizeLabels        *bool              `toml:"sanitize_labels"`
+	CollapseWhitespace    *bool              `toml:"collapse_whitespace"`
+	MaxLabelLength        int                `toml:"max_label_length"`
+	EnforceNaming         *bool              `toml:"enforce_naming"`
+	UnmatchedPathEvents   int                `toml:"unmatched_path_events"`
+	Namespace             string
+	Subsystem             string
+	Metrics               map[string]Metric
+}
+
+type Metric struct {
+	Type                MetricType
+	NameTemplate        string   `toml:"name_template"`
+	MaxGenerated        int      `toml:"max_generated"`
+	SampleRate          float64  `toml:"sample_rate"`
+	JSONFields          []string `toml:"json_fields"`
+	Identity            []string
+	States              []string
+	StateLabel          string            `toml:"state_label"`
+	UnknownState        string            `toml:"unknown_state"`
+	NegativeLag         string            `toml:"negative_lag"`
+	BucketPaths         map[string]string `toml:"bucket_paths"`
+	SumPath             string            `toml:"sum_path"`
+	CountPath           string            `toml:"count_path"`
+	BucketUpdate        string            `toml:"bucket_update"`
+	Quantiles           []float64
+	ReservoirSize       int `toml:"reservoir_size"`
+	Smoothing           string
+	Alpha               *float64
+	HalfLife            Duration `toml:"half_life"`
+	Unit                string
+	NonFiniteAction     NonFiniteAction `toml:"non_finite_action"`
+	Min                 *float64
+	Max                 *float64
+	BoundsAction        string            `toml:"bounds_action"`
+	NegativeAction      string            `toml:"negative_action"`
+	GaugeMode           string            `toml:"gauge_mode"`
+	ExemplarLabels      map[string]string `toml:"exemplar_labels"`
+	Reset               string
+	ResetInterval       Duration `toml:"reset_interval"`
+	EnforceNaming       *bool    `toml:"enforce_naming"`
+	UnmatchedPathEvents int      `toml:"unmatched_path_events"`
+	Namespace           string
+	Subsystem           string
+	Help                string
+	Tag                 string
+	TagPattern          string `toml:"tag_pattern"`
+	Pattern             string
+	Filters             []Filter
+	FilterMode          FilterMode `toml:"filter_mode"`
+	DeleteWhen          []Filter   `toml:"delete_when"`
+	DeleteWhenMode      FilterMode `toml:"delete_when_mode"`
+	Threshold           *float64
+	Value               ValuePath
+	ValueLabel          string         `toml:"value_label"`
+	ValueExpr           string         `toml:"value_expr"`
+	DivisionByZero      DivisionByZero `toml:"division_by_zero"`
+	CountMode           CountMode      `toml:"count_mode"`
+	Labels              map[string]LabelSource
+	MissingLabelAction  MissingLabelAction `toml:"missing_label_action"`
+	MissingLabelDefault string             `toml:"missing_label_default"`
+	SanitizeLabels      *bool              `toml:"sanitize_labels"`
+	CollapseWhitespace  *bool              `toml:"collapse_whitespace"`
+	MaxLabelLength      int                `toml:"max_label_length"`
+	ConstLabels         map[string]string  `toml:"const_labels"`
+	Buckets             []float64
+	Objectives          map[string]float64
+	MaxAge              Duration `toml:"max_age"`
+	AgeBuckets          uint32   `toml:"age_buckets"`
+	TTL                 Duration
+	MaxSeries           int                 `toml:"max_series"`
+	ChildCacheSize      int                 `toml:"child_cache_size"`
+	TopK                int                 `toml:"topk"`
+	InitialLabelValues  [][]string          `toml:"initial_label_values"`
+	InitialLabels       map[string][]string `toml:"initial_labels"`
+	KeepInitialSeries   bool                `toml:"keep_initial_series"`
+	OverflowAction      OverflowAction      `toml:"overflow_action"`
+	OnError             ErrorPolicy         `toml:"on_error"`
+	StrictTypes         bool                `toml:"strict_types"`
+	ValueFormat         ValueFormat         `toml:"value_format"`
+	ValueMap            map[string]float64  `toml:"value_map"`
+	ValueMapDefault     *float64            `toml:"value_map_default"`
+	DefaultValue        *float64            `toml:"default_value"`
+	MissingAction       MissingAction       `toml:"missing_action"`
+	ArrayMode           ArrayMode           `toml:"array_mode"`
+	Aggregate           Aggregation         `toml:"aggregate"`
+	AggregateWindow     Duration            `toml:"aggregate_window"`
+	RateWindow          Duration            `toml:"rate_window"`
+	Window              Duration
+	DistinctMode        DistinctMode `toml:"distinct_mode"`
+	MaxDistinct         int          `toml:"max_distinct"`
+	Precision           uint8
+	Scale               *float64
+	Offset              float64
+	name                string
+	labelKeys           []string
+	labels              []label
+	values              []valueEntry
+	expr                expr
+	patternRe           *regexp.Regexp
+	tagRe               *regexp.Regexp
+	tagGroupRe          *regexp.Regexp
+	expirer             *seriesExpirer
+	limiter             *seriesLimiter
+	sampler             *sampler
+	labelPool           *sync.Pool
+	st                  *stats
+	paths               map[string]compiledPath
+	chains              map[string][]string
+	watch               *pathWatch
+	consumption         metricStats
+}
+
+// New creates the handler of the metric defined with name and registers it
+// with reg. st may be nil, in which case the internal statistics are kept
+// unregistered.
+func (m *Metric) New(name string, reg prometheus.Registerer, st *stats) (Handler, error) {
+	if st == nil {
+		st = newStats()
+	}
+	raw := *m
+	m.name = name
+	m.st = st
+	if err := m.checkNaming(name); err != nil {
+		return nil, err
+	}
+	name = m.fqName(name)
+	if err := validateMetricName(name); err != nil {
+		return nil, err
+	}
+	m.Help = m.helpText(name)
+	if m.CountMode == "" {
+		m.CountMode = "value"
+	}
+	if m.OverflowAction == "" {
+		m.OverflowAction = "drop"
+	}
+	if m.OnError == "" {
+		m.OnError = "log"
+	}
+	if m.ArrayMode == "" {
+		m.ArrayMode = "each"
+	}
+	if m.NonFiniteAction == "" {
+		m.NonFiniteAction = "skip"
+	}
+	switch m.BoundsAction {
+	case "":
+		m.BoundsAction = "clamp"
+	case "clamp", "drop", "error":
+	default:
+		return nil, fmt.Errorf("Unknown bounds_action of %s: %s", name, m.BoundsAction)
+	}
+	switch m.NegativeAction {
+	case "":
+		m.NegativeAction = "error"
+	case "error", "skip", "clamp_zero", "absolute":
+	default:
+		return nil, fmt.Errorf("Unknown negative_action of %s: %s", name, m.NegativeAction)
+	}
+	if m.Min != nil && m.Max != nil && *m.Min > *m.Max {
+		return nil, fmt.Errorf("min of %s is greater than max", name)
+	}
+	if m.MissingLabelAction == "" {
+		m.MissingLabelAction = "empty"
+	}
+	if m.CountMode == "match" || m.CountMode == "not_match" {
+		if m.Pattern == "" {
+			return nil, fmt.Errorf("pattern of %s is required by count_mode = %q", name, m.CountMode)
+		}
+		re, err := regexp.Compile(m.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid pattern %q: %v", m.Pattern, err)
+		}
+		m.patternRe = re
+	}
+	switch m.NegativeLag {
+	case "", "clamp", "keep":
+	default:
+		return nil, fmt.Errorf("Unknown negative_lag of %s: %s", name, m.NegativeLag)
+	}
+	if m.SampleRate < 0 || m.SampleRate > 1 {
+		return nil, fmt.Errorf("sample_rate of %s must be in (0, 1]: %v", name, m.SampleRate)
+	}
+	if m.SampleRate > 0 && m.SampleRate < 1 {
+		m.sampler = newSampler(m.SampleRate)
+	}
+	var err error
+	if m.Filters, err = compileFilters(m.Filters); err != nil {
+		return nil, fmt.Errorf("Invalid filter of %s: %v", name, err)
+	}
+	if m.DeleteWhen, err = compileFilters(m.DeleteWhen); err != nil {
+		return nil, fmt.Errorf("Invalid delete_when of %s: %v", name, err)
+	}
+	switch m.CountMode {
+	case "gt", "ge", "lt", "le", "eq", "ne":
+		if m.Threshold == nil {
+			return nil, fmt.Errorf("threshold of %s is required by count_mode = %q", name, m.CountMode)
+		}
+	}
+	if m.DivisionByZero == "" {
+		m.DivisionByZero = "skip"
+	}
+	if m.ValueExpr != "" {
+		if !m.Value.isEmpty() {
+			return nil, fmt.Errorf("Only one of value and value_expr can be set for %s", name)
+		}
+		e, err := parseExpr(m.ValueExpr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value_expr of %s: %v", name, err)
+		}
+		m.expr = e
+	}
+	if m.MissingAction == "" {
+		m.MissingAction = "skip"
+		if m.DefaultValue != nil {
+			m.MissingAction = "default"
+		}
+	}
+	if m.MissingAction == "default" && m.DefaultValue == nil {
+		return nil, fmt.Errorf("default_value of %s is required by missing_action = \"default\"", name)
+	}
+	if m.Tag != "" {
+		re, err := compileTagPattern(m.Tag)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid tag pattern %q: %v", m.Tag, err)
+		}
+		m.tagRe = re
+	}
+	groups := make(map[string]int)
+	if m.TagPattern != "" {
+		re, err := regexp.Compile(m.TagPattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid tag_pattern %q: %v", m.TagPattern, err)
+		}
+		m.tagGroupRe = re
+		for i, group := range re.SubexpNames() {
+			if group != "" {
+				groups[group] = i
+				m.labelKeys = append(m.labelKeys, group)
+			}
+		}
+	}
+	if m.Value.Paths != nil {
+		if m.ValueLabel == "" {
+			m.ValueLabel = "path"
+		}
+		m.labelKeys = append(m.labelKeys, m.ValueLabel)
+		keys := make([]string, 0, len(m.Value.Paths))
+		for key := range m.Value.Paths {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			m.values = append(m.values, valueEntry{key, m.Value.Paths[key]})
+		}
+	} else {
+		m.values = []valueEntry{{"", m.Value.Path}}
+	}
+	for key := range m.Labels {
+		if _, ok := m.ConstLabels[key]; ok {
+			return nil, fmt.Errorf("Label %s of %s is defined in both labels and const_labels", key, name)
+		}
+		if _, ok := groups[key]; ok {
+			return nil, fmt.Errorf("Label %s of %s is defined in both labels and tag_pattern", key, name)
+		}
+		if m.Value.Paths != nil && key == m.ValueLabel {
+			return nil, fmt.Errorf("Label %s of %s is defined in both labels and value_label", key, name)
+		}
+		m.labelKeys = append(m.labelKeys, key)
+	}
+	sort.Strings(m.labelKeys)
+	for _, key := range m.labelKeys {
+		if err := validateLabelName(name, key); err != nil {
+			return nil, err
+		}
+	}
+	for key := range m.ConstLabels {
+		if err := validateLabelName(name, key); err != nil {
+			return nil, err
+		}
+	}
+	for _, key := range m.labelKeys {
+		if i, ok := groups[key]; ok {
+			m.labels = append(m.labels, label{tagGroup: i})
+			continue
+		}
+		if m.Value.Paths != nil && key == m.ValueLabel {
+			m.labels = append(m.labels, label{fromValue: true})
+			continue
+		}
+		l, err := newLabel(m.Labels[key].Path)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid path of label %s: %v", key, err)
+		}
+		l.def = m.Labels[key].Default
+		if l.transform, err = m.Labels[key].pipeline(); err != nil {
+			return nil, fmt.Errorf("Invalid label %s of %s: %v", key, name, err)
+		}
+		m.labels = append(m.labels, l)
+	}
+	if err := m.compilePaths(); err != nil {
+		return nil, fmt.Errorf("Invalid path of %s: %v", name, err)
+	}
+	if err := m.checkWildcards(); err != nil {
+		return nil, fmt.Errorf("Invalid path of %s: %v", name, err)
+	}
+	// Children of a templated metric share the watch of their template.
+	if m.watch == nil {
+		var watched []string
+		for _, e := range m.values {
+			watched = append(watched, e.path)
+		}
+		for _, l := range m.labels {
+			if l.path != "" {
+				watched = append(watched, l.path)
+			}
+		}
+		m.watch = newPathWatch(m.UnmatchedPathEvents, watched)
+	}
+	if len(m.ExemplarLabels) > 0 {
+		if m.Type != "counter" && m.Type != "histogram" {
+			return nil, fmt.Errorf("exemplar_labels of %s requires counter or histogram", name)
+		}
+		for key := range m.ExemplarLabels {
+			if err := validateLabelName(name, key); err != nil {
+				return nil, err
+			}
+		}
+	}
+	initial, err := m.initialSeries(m.labelKeys)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid initial series of %s: %v", name, err)
+	}
+	if m.TopK > 0 {
+		switch {
+		case m.Type != "counter":
+			return nil, fmt.Errorf("topk of %s requires counter", name)
+		case len(m.labelKeys) == 0:
+			return nil, fmt.Errorf("topk of %s requires labels", name)
+		case m.MaxSeries > 0 || m.TTL.Duration > 0 || len(m.DeleteWhen) > 0:
+			return nil, fmt.Errorf("topk of %s cannot be used with max_series, ttl or delete_when", name)
+		case len(m.ExemplarLabels) > 0 || len(initial) > 0:
+			return nil, fmt.Errorf("topk of %s cannot be used with exemplar_labels or initial series", name)
+		}
+	}
+	if m.MaxSeries > 0 {
+		if m.OverflowAction == "fold" {
+			_, isConst := m.ConstLabels[overflowLabel]
+			_, isGroup := groups[overflowLabel]
+			if _, ok := m.Labels[overflowLabel]; ok || isConst || isGroup {
+				return nil, fmt.Errorf("Label %s of %s is reserved by overflow_action = \"fold\"", overflowLabel, name)
+			}
+			m.labelKeys = append(m.labelKeys, overflowLabel)
+		}
+		m.limiter = newSeriesLimiter(m.name, m.MaxSeries, m.OverflowAction, len(m.labelKeys), st)
+	}
+	if m.TTL.Duration > 0 || len(m.DeleteWhen) > 0 {
+		m.expirer = newSeriesExpirer(m.TTL.Duration)
+		if m.limiter != nil {
+			m.expirer.forget = append(m.expirer.forget, m.limiter.forget)
+		}
+	}
+	nlabels := len(m.labelKeys)
+	m.labelPool = &sync.Pool{New: func() interface{} {
+		return &labelScratch{vals: make([]string, 0, nlabels)}
+	}}
+
+	if m.NameTemplate != "" {
+		t, err := newTemplatedMetric(m.name, m, raw, st)
+		if err == nil {
+			err = reg.Register(t)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return t, nil
+	}
+
+	var h Handler
+	switch m.Type {
+	case "gauge":
+		switch m.GaugeMode {
+		case "", "set":
+		case "inc", "dec", "add", "sub":
+			if m.Smoothing != "" || m.Aggregate != "" && m.Aggregate != "last" {
+				return nil, fmt.Errorf("gauge_mode %s of %s cannot be used with smoothing or aggregate", m.GaugeMode, name)
+			}
+		default:
+			return nil, fmt.Errorf("Unknown gauge_mode of %s: %s", name, m.GaugeMode)
+		}
+		if m.Aggregate != "" && m.Aggregate != "last" {
+			if m.Smoothing != "" {
+				return nil, fmt.Errorf("smoothing and aggregate of %s are exclusive", name)
+			}
+			h, err = newAggregateGauge(name, m, reg)
+		} else {
+			h, err = newGauge(name, m, reg)
+		}
+	case "counter":
+		if m.Reset != "" || m.ResetInterval.Duration > 0 {
+			h, err = newResetCounter(name, m, reg)
+		} else {
+			h, err = newCounter(name, m, reg)
+		}
+	case "histogram":
+		if m.BucketPaths != nil {
+			h, err = newBucketedHistogram(name, m, reg)
+		} else {
+			h, err = newHistogram(name, m, reg)
+		}
+	case "summary":
+		h, err = newSummary(name, m, reg)
+	case "rate":
+		h, err = newRate(name, m, reg)
+	case "distinct":
+		h, err = newDistinct(name, m, reg)
+	case "info":
+		h, err = newInfo(name, m, reg)
+	case "enum":
+		h, err = newEnum(name, m, reg)
+	case "percentiles":
+		h, err = newPercentiles(name, m, reg)
+	default:
+		return nil, fmt.Errorf("Unknown metric type: %v", m.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if m.expirer != nil {
+		m.expirer.vec = h
+	}
+	if err := m.initSeries(h, initial); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// MatchRecord reports whether the record of the event passes the filters.
+func (m *Metric) MatchRecord(ev *event) bool {
+	return m.matchFilters(ev, m.Filters, m.FilterMode == "any")
+}
+
+// sample reports whether the event should be processed per sample_rate.
+// Sampling a gauge just means fewer updates, whereas counters scale their
+// increments so that they remain unbiased estimates.
+func (m *Metric) sample() bool {
+	return m.sampler == nil || m.sampler.sample()
+}
+
+func (m *Metric) jsonFields() []string {
+	return m.JSONFields
+}
+
+// helpText returns the help of the metric, in which {name}, {type}, {tag} and
+// {value} are replaced with the definition. The default help describes where
+// the metric comes from.
+func (m *Metric) helpText(name string) string {
+	value := m.ValueExpr
+	if value == "" {
+		value = m.Value.Path
+	}
+	if m.Value.Paths != nil {
+		paths := make([]string, 0, len(m.Value.Paths))
+		for _, p := range m.Value.Paths {
+			paths = append(paths, p)
+		}
+		sort.Strings(paths)
+		value = strings.Join(paths, ", ")
+	}
+	help := m.Help
+	if help == "" {
+		if value == "" {
+			help = "{name} generated by fluxion out-prometheus from events"
+		} else {
+			help = "{name} generated by fluxion out-prometheus from path {value}"
+		}
+		if m.Tag != "" {
+			help += " tagged {tag}"
+		}
+	}
+	return strings.NewReplacer("{name}", name, "{type}", string(m.Type), "{tag}", m.Tag, "{value}", value).Replace(help)
+}
+
+// fqName returns the fully-qualified name of the metric defined with name,
+// prefixed with namespace and subsystem if any. The suffix of unit is
+// appended unless the name already has it, and so is "_total" for counters if
+// naming is enforced.
+func (m *Metric) fqName(name string) string {
+	base := strings.TrimSuffix(name, "_total")
+	total := base != name || m.Type == "counter" && m.EnforceNaming != nil && *m.EnforceNaming
+	if m.Unit != "" && !strings.HasSuffix(base, "_"+m.Unit) {
+		base += "_" + m.Unit
+	}
+	base = prometheus.BuildFQName(m.Namespace, m.Subsystem, base)
+	if total {
+		return base + "_total"
+	}
+	return base
+}
+
+func (m *Metric) MatchTag(tag string) bool {
+	if m.tagRe != nil && !m.tagRe.MatchString(tag) {
+		return false
+	}
+	return m.tagGroupRe == nil || m.tagGroupRe.MatchString(tag)
+}
+
+// Start resolves the per-metric statistics and the path ids of the handler
+// and Close does nothing. Handlers with background work override them, calling Metric.Start
+// from their Start.
+func (m *Metric) Start(ctx context.Context) error {
+	m.consumption = m.st.metric(m.name)
+	m.indexPaths()
+	return nil
+}
+
+func (m *Metric) Close() error { return nil }
+
+func (m *Metric) metricName() string {
+	return m.name
+}
+
+func (m *Metric) errorPolicy() ErrorPolicy {
+	return m.OnError
+}
+
+func (m *Metric) expiry() *seriesExpirer {
+	return m.expirer
+}
+
+func (m *Metric) consumed(now time.Time) {
+	m.consumption.consumed(now)
+}
+
+func (m *Metric) unmatchedPaths() []string {
+	if m.watch == nil {
+		return nil
+	}
+	return m.watch.unmatched()
+}
+
+// labelScratch is the buffer label values are resolved into. It is pooled
+// per metric to save an allocation per sample, so the label values must be
+// copied by whatever keeps them after the event is handled.
+type labelScratch struct {
+	vals []string
+}
+
+func (m *Metric) scratch() *labelScratch {
+	return m.labelPool.Get().(*labelScratch)
+}
+
+func (m *Metric) release(s *labelScratch) {
+	m.labelPool.Put(s)
+}
+
+// labelValues resolves the label values of the event for the value identified
+// by key into s. The resulting label set is subject to max_series and marked
+// as updated if the metric has a TTL. errSkip is returned if the sample must
+// be dropped.
+func (m *Metric) labelValues(ev *event, key string, s *labelScratch) ([]string, error) {
+	return m.labelValuesAt(ev, key, -1, s)
+}
+
+// labelValuesAt is labelValues for the ith element of the arrays referred to
+// by wildcard paths.
+func (m *Metric) labelValuesAt(ev *event, key string, elem int, s *labelScratch) ([]string, error) {
+	vals, err := m.resolveLabels(ev, key, elem, s.vals[:0])
+	if err != nil {
+		return nil, err
+	}
+	s.vals = vals
+	if m.limiter != nil {
+		var ok bool
+		if vals, ok = m.limiter.admit(vals); !ok {
+			return nil, errSkip
+		}
+	}
+	if m.expirer != nil {
+		m.expirer.touch(vals)
+	}
+	return vals, nil
+}
+
+// resolveLabels appends the label values of the event to vals without
+// affecting the series tracking.
+func (m *Metric) resolveLabels(ev *event, key string, elem int, vals []string) ([]string, error) {
+	var groups []string
+	if m.tagGroupRe != nil {
+		groups = m.tagGroupRe.FindStringSubmatch(ev.Tag)
+	}
+	for _, l := range m.labels {
+		var s string
+		if l.fromValue {
+			s = key
+		} else if l.tagGroup > 0 {
+			if l.tagGroup < len(groups) {
+				s = groups[l.tagGroup]
+			}
+		} else if l.fromTag {
+			s = tagPart(ev.Tag, l.tagIndex)
+		} else {
+			raw, found, err := m.lookupElement(ev, l.path, elem)
+			if err != nil {
+				return nil, err
+			}
+			var ok bool
+			if !found {
+				if s, ok = m.missingLabel(l); !ok {
+					return nil, errSkip
+				}
+			} else if s, ok = toString(raw); !ok {
+				return nil, &handlerError{errTypeMismatch, fmt.Errorf("%s: cannot convert %T to label value", l.path, raw)}
+			}
+		}
+		if !l.fromValue {
+			for _, t := range l.transform {
+				s = t(s)
+			}
+			if m.SanitizeLabels == nil || *m.SanitizeLabels {
+				s = sanitizeLabel(s, m.CollapseWhitespace == nil || *m.CollapseWhitespace)
+			}
+			s = truncateLabel(s, m.MaxLabelLength)
+		}
+		vals = append(vals, s)
+	}
+	if m.limiter != nil && m.OverflowAction == "fold" {
+		vals = append(vals, "")
+	}
+	return vals, nil
+}
+
+// tombstone deletes the series the event refers to if it matches delete_when.
+// It reports whether the event was consumed as a deletion.
+func (m *Metric) tombstone(ev *event) (bool, error) {
+	if len(m.DeleteWhen) == 0 || !m.matchFilters(ev, m.DeleteWhen, m.DeleteWhenMode == "any") {
+		return false, nil
+	}
+	var first error
+	s := m.scratch()
+	defer m.release(s)
+	for _, e := range m.values {
+		lvals, err := m.resolveLabels(ev, e.key, -1, s.vals[:0])
+		if err == nil {
+			m.expirer.remove(lvals)
+		} else if err != errSkip && first == nil {
+			first = err
+		}
+	}
+	return true, first
+}
+
+// missingLabel returns the value of the label whose path is missing in the
+// record. It returns false if the event should be dropped.
+func (m *Metric) missingLabel(l label) (string, bool) {
+	if l.def != nil {
+		return *l.def, true
+	}
+	switch m.MissingLabelAction {
+	case "default":
+		return m.MissingLabelDefault, true
+	case "drop":
+		return "", false
+	}
+	return "", true
+}
+
+// valueEntry is a value path of a metric. key is the value of value_label for
+// a metric having multiple value paths.
+type valueEntry struct {
+	key  string
+	path string
+}
+
+// each calls f with each value of the event and the label values of the
+// series it applies to. Values skipped per missing_action or max_series are
+// ignored, and the first error is returned after all values are processed.
+func (m *Metric) each(ev *event, f func(float64, []string) error) error {
+	var first error
+	s := m.scratch()
+	defer m.release(s)
+	for _, e := range m.values {
+		if m.paths[e.path].hasWildcard() {
+			if err := m.eachElement(ev, e, s, f); err != nil && first == nil {
+				first = err
+			}
+			continue
+		}
+		vs, err := m.samples(ev, e.path)
+		if err == nil && len(vs) > 0 {
+			var lvals []string
+			if lvals, err = m.labelValues(ev, e.key, s); err == nil {
+				for _, v := range vs {
+					if err = f(v, lvals); err != nil {
+						break
+					}
+				}
+			}
+		}
+		if err != nil && err != errSkip && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// eachElement is each for a value path having a wildcard. Every element of the
+// array yields samples labeled with the label paths evaluated against the
+// same element. An absent array yields no samples.
+func (m *Metric) eachElement(ev *event, e valueEntry, s *labelScratch, f func(float64, []string) error) error {
+	elems, rest, ok := m.paths[e.path].elements(ev.Record)
+	if !ok {
+		if _, err := m.missing(e.path); err != nil {
+			return err
+		}
+		return nil
+	}
+	var first error
+	for i, x := range elems {
+		raw, found := rest.walkFrom(x)
+		vs, err := m.sampleValue(raw, found, e.path)
+		if err == nil && len(vs) > 0 {
+			var lvals []string
+			if lvals, err = m.labelValuesAt(ev, e.key, i, s); err == nil {
+				for _, v := range vs {
+					if err = f(v, lvals); err != nil {
+						break
+					}
+				}
+			}
+		}
+		if err != nil && err != errSkip && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// lookupElement is lookup for the ith element of the array if the path has a
+// wildcard. It is an error if the array has no such element.
+func (m *Metric) lookupElement(ev *event, p string, elem int) (interface{}, bool, error) {
+	fp := m.paths[p]
+	if elem < 0 || !fp.hasWildcard() {
+		return m.lookup(ev, p)
+	}
+	elems, rest, ok := fp.elements(ev.Record)
+	if !ok || elem >= len(elems) {
+		return nil, false, &handlerError{errMisaligned, fmt.Errorf("%s: array has no element %d", p, elem)}
+	}
+	v, found := rest.walkFrom(elems[elem])
+	return v, found, nil
+}
+
+// samples returns the values at path p of the event, transformed by scale and
+// offset. An array yields a value for each element or a single aggregated
+// value per array_mode. If the value is missing, it is handled per
+// missing_action; default_value is used as is without the transformation.
+func (m *Metric) samples(ev *event, p string) ([]float64, error) {
+	if m.expr != nil {
+		return m.evalExpr(ev)
+	}
+	if chain, ok := m.chains[p]; ok {
+		return m.fallbackSamples(ev, p, chain)
+	}
+	raw, found, err := m.lookup(ev, p)
+	if err != nil {
+		return nil, err
+	}
+	return m.sampleValue(raw, found, p)
+}
+
+// fallbackSamples returns the samples of the first path in chain having a
+// usable value. If none has, the error of the first path found is returned,
+// or the value is handled as missing if no path is found.
+func (m *Metric) fallbackSamples(ev *event, p string, chain []string) ([]float64, error) {
+	var first error
+	for _, c := range chain {
+		raw, found, err := m.lookup(ev, c)
+		if err == nil && !found {
+			continue
+		}
+		var vs []float64
+		if err == nil {
+			vs, err = m.sampleValue(raw, true, c)
+		}
+		if err == nil {
+			return vs, nil
+		}
+		if first == nil {
+			first = err
+		}
+	}
+	if first != nil {
+		return nil, first
+	}
+	return m.missing(p)
+}
+
+// sampleValue is samples for the value raw found at path p.
+func (m *Metric) sampleValue(raw interface{}, found bool, p string) ([]float64, error) {
+	if !found {
+		return m.missing(p)
+	}
+	var err error
+	var vs []float64
+	if a, ok := raw.([]interface{}); ok {
+		if vs, err = m.convertArray(a, p); err != nil {
+			return nil, err
+		}
+	} else {
+		v, err := m.convert(raw, p)
+		if err != nil {
+			return nil, err
+		}
+		vs = []float64{v}
+	}
+	for i := range vs {
+		vs[i] = m.transform(vs[i])
+	}
+	return m.finalize(vs, p)
+}
+
+func (m *Metric) transform(v float64) float64 {
+	if m.Scale != nil {
+		v *= *m.Scale
+	}
+	return v + m.Offset
+}
+
+// finalize applies non_finite_action, and then min and max per bounds_action
+// to the transformed values of path p.
+func (m *Metric) finalize(vs []float64, p string) ([]float64, error) {
+	if m.NonFiniteAction == "pass" && m.Min == nil && m.Max == nil {
+		return vs, nil
+	}
+	out := vs[:0]
+	for _, v := range vs {
+		if m.NonFiniteAction == "pass" || !math.IsNaN(v) && !math.IsInf(v, 0) {
+			v, ok, err := m.bound(v, p)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				out = append(out, v)
+			}
+			continue
+		}
+		switch m.NonFiniteAction {
+		case "zero":
+			out = append(out, 0)
+		case "error":
+			return nil, &handlerError{errNonFinite, fmt.Errorf("%s: non-finite value %v", p, v)}
+		default:
+			m.st.samplesDropped.WithLabelValues(m.name, "non_finite").Inc()
+		}
+	}
+	if len(out) == 0 && len(vs) > 0 {
+		return nil, errSkip
+	}
+	return out, nil
+}
+
+// bound applies min and max to v. false is returned if v is dropped.
+func (m *Metric) bound(v float64, p string) (float64, bool, error) {
+	var limit float64
+	switch {
+	case m.Min != nil && v < *m.Min:
+		limit = *m.Min
+	case m.Max != nil && v > *m.Max:
+		limit = *m.Max
+	default:
+		return v, true, nil
+	}
+	switch m.BoundsAction {
+	case "drop":
+		m.st.samplesDropped.WithLabelValues(m.name, "out_of_bounds").Inc()
+		return 0, false, nil
+	case "error":
+		return 0, false, &handlerError{errOutOfBounds, fmt.Errorf("%s: value %v is out of bounds", p, v)}
+	}
+	return limit, true, nil
+}
+
+func (m *Metric) missing(p string) ([]float64, error) {
+	switch m.MissingAction {
+	case "default":
+		return []float64{*m.DefaultValue}, nil
+	case "error":
+		return nil, &handlerError{errMissing, fmt.Errorf("%s: missing value", p)}
+	}
+	return nil, errSkip
+}
+
+// evalExpr evaluates value_expr against the event. Division by zero yields
+// zero or skips the event per division_by_zero.
+func (m *Metric) evalExpr(ev *event) ([]float64, error) {
+	v, err := m.expr.eval(func(p string) (float64, error) {
+		raw, found, err := m.lookup(ev, p)
+		if err != nil {
+			return 0, err
+		}
+		if !found {
+			return 0, errMissingOperand
+		}
+		return m.convert(raw, p)
+	})
+	switch err {
+	case nil:
+	case errMissingOperand:
+		return m.missing(m.ValueExpr)
+	case errDivisionByZero:
+		if m.DivisionByZero == "skip" {
+			return nil, errSkip
+		}
+		v = 0
+	default:
+		return nil, err
+	}
+	return m.finalize([]float64{m.transform(v)}, m.ValueExpr)
+}
+
+// convertArray converts the elements of an array per array_mode.
+func (m *Metric) convertArray(a []interface{}, p string) ([]float64, error) {
+	if m.ArrayMode == "len" {
+		return []float64{float64(len(a))}, nil
+	}
+	vs := make([]float64, len(a))
+	for i, raw := range a {
+		v, err := m.convert(raw, p)
+		if err != nil {
+			return nil, err
+		}
+		vs[i] = v
+	}
+	if m.ArrayMode == "each" {
+		return vs, nil
+	}
+	if len(vs) == 0 {
+		if m.ArrayMode == "sum" {
+			return []float64{0}, nil
+		}
+		return nil, nil
+	}
+	acc := vs[0]
+	for _, v := range vs[1:] {
+		switch m.ArrayMode {
+		case "sum", "avg":
+			acc += v
+		case "min":
+			acc = math.Min(acc, v)
+		case "max":
+			acc = math.Max(acc, v)
+		}
+	}
+	if m.ArrayMode == "avg" {
+		acc /= float64(len(vs))
+	}
+	return []float64{acc}, nil
+}
+
+// convert converts a value scanned from the record into float64. Strings are
+// parsed per value_format or looked up in value_map if defined. Unless
+// strict_types is set, any numeric type or numeric string is accepted.
+func (m *Metric) convert(raw interface{}, p string) (float64, error) {
+	if raw == nil {
+		return 0, nil
+	}
+	if b, ok := raw.([]byte); ok {
+		raw = string(b)
+	}
+	if s, ok := raw.(string); ok && m.ValueFormat != "" {
+		v, err := parseFormatted(m.ValueFormat, s)
+		if err != nil {
+			return 0, &handlerError{errParse, fmt.Errorf("%s: %v", p, err)}
+		}
+		return v, nil
+	}
+	if s, ok := raw.(string); ok && m.ValueMap != nil {
+		if v, ok := m.ValueMap[s]; ok {
+			return v, nil
+		}
+		if m.ValueMapDefault != nil {
+			return *m.ValueMapDefault, nil
+		}
+		return 0, &handlerError{errUnknownValue, fmt.Errorf("%s: %q is not defined in value_map", p, s)}
+	}
+	if m.StrictTypes {
+		if v, ok := raw.(float64); ok {
+			return v, nil
+		}
+	} else if v, ok := toFloat(raw); ok {
+		return v, nil
+	}
+	return 0, &handlerError{errTypeMismatch, fmt.Errorf("%s: cannot convert %T to number", p, raw)}
+}
+
+// timePath is the path referring to the time of the event in unix seconds.
+const timePath = "$time"
+
+// lagPath is the path referring to the delay of the event, the seconds
+// elapsed since its time. A negative lag caused by clock skew is clamped at 0
+// unless negative_lag is "keep".
+const lagPath = "$lag"
+
+// lookup returns the value at path p of the record. false is returned if the
+// path does not exist in the record.
+func (m *Metric) lookup(ev *event, p string) (interface{}, bool, error) {
+	if p == timePath {
+		return unixSeconds(ev.Time), true, nil
+	}
+	if p == lagPath {
+		lag := time.Since(ev.Time).Seconds()
+		if lag < 0 && m.NegativeLag != "keep" {
+			lag = 0
+		}
+		return lag, true, nil
+	}
+	v, found, err := m.lookupPath(ev, p)
+	if m.watch != nil {
+		m.watch.observe(p, found)
+	}
+	return v, found, err
+}
+
+func (m *Metric) lookupPath(ev *event, p string) (interface{}, bool, error) {
+	if chain, ok := m.chains[p]; ok {
+		for _, c := range chain {
+			if v, found, err := m.lookup(ev, c); found || err != nil {
+				return v, found, err
+			}
+		}
+		return nil, false, nil
+	}
+	fp, ok := m.paths[p]
+	x := ev.x
+	if x != nil && ok {
+		if v, found, ok := x.get(fp.id); ok {
+			return v, found, nil
+		}
+	}
+	if !ok {
+		parsed, err := parsePath(p)
+		if err != nil {
+			return nil, false, &handlerError{errScan, err}
+		}
+		fp = compiledPath{parsed, -1}
+	}
+	v, found := fp.walk(ev.Record)
+	if x != nil {
+		x.put(fp.id, v, found)
+	}
+	return v, found, nil
+}
+
+// compiledPath is a parsed path of a metric and its id in the path index of
+// the plugin, which is -1 until the handler is started.
+type compiledPath struct {
+	fieldPath
+	id int
+}
+
+// indexPaths assigns the ids of the paths of the metric, by which the lookups
+// are shared with the other handlers of an event.
+func (m *Metric) indexPaths() {
+	for p, fp := range m.paths {
+		fp.id = m.st.paths.id(p)
+		m.paths[p] = fp
+	}
+}
+
+// compilePaths parses every path the metric refers to once, so that lookup
+// does not parse them per event and invalid paths are rejected up front.
+func (m *Metric) compilePaths() error {
+	m.paths = make(map[string]compiledPath)
+	m.chains = make(map[string][]string)
+	if len(m.Value.Candidates) > 0 {
+		m.chains[m.Value.Path] = m.Value.Candidates
+	}
+	for _, src := range m.Labels {
+		if len(src.Candidates) > 0 {
+			m.chains[src.Path] = src.Candidates
+		}
+	}
+	var first error
+	var add func(string)
+	add = func(p string) {
+		if _, ok := m.paths[p]; ok {
+			return
+		}
+		if chain, ok := m.chains[p]; ok {
+			for _, c := range chain {
+				add(c)
+				if m.paths[c].hasWildcard() && first == nil {
+					first = fmt.Errorf("fallback path %s cannot have a wildcard", c)
+				}
+			}
+			return
+		}
+		fp, err := parsePath(p)
+		if err != nil && first == nil {
+			first = err
+		}
+		m.paths[p] = compiledPath{fp, -1}
+	}
+	for _, e := range m.values {
+		add(e.path)
+	}
+	for _, l := range m.labels {
+		if l.path != "" {
+			add(l.path)
+		}
+	}
+	for _, f := range m.Filters {
+		add(f.Path)
+	}
+	for _, f := range m.DeleteWhen {
+		add(f.Path)
+	}
+	for _, p := range m.BucketPaths {
+		add(p)
+	}
+	for _, p := range []string{m.SumPath, m.CountPath} {
+		if p != "" {
+			add(p)
+		}
+	}
+	for _, p := range m.ExemplarLabels {
+		add(p)
+	}
+	if m.expr != nil {
+		walkExprPaths(m.expr, add)
+	}
+	return first
+}
+
+// checkWildcards ensures that wildcard paths are used where they are
+// supported: value paths of gauges, histograms, summaries and counters and
+// rates in the value or delta count mode, and labels of such values.
+func (m *Metric) checkWildcards() error {
+	values := false
+	for _, e := range m.values {
+		if m.paths[e.path].hasWildcard() {
+			values = true
+		} else if values {
+			return fmt.Errorf("either all or none of value paths must have a wildcard")
+		}
+	}
+	if values {
+		counting := m.Type == "counter" || m.Type == "rate"
+		if m.Type == "distinct" || m.Type == "enum" || counting && m.CountMode != "value" && m.CountMode != "delta" {
+			return fmt.Errorf("wildcard value path is not supported by this metric type or count_mode")
+		}
+	}
+	for _, l := range m.labels {
+		if l.path != "" && m.paths[l.path].hasWildcard() && !values {
+			return fmt.Errorf("wildcard label path %s requires a wildcard value path", l.path)
+		}
+	}
+	return nil
+}
+
+// label describes where the value of a label comes from. It is either the
+// record path, the event tag, referred to as "$tag" or "$tag[n]", a named
+// group of tag_pattern, or the key of the value for value_label.
+type label struct {
+	path      string
+	fromTag   bool
+	tagIndex  int
+	tagGroup  int
+	fromValue bool
+	def       *string
+	transform []func(string) string
+}
+
+func newLabel(p string) (label, error) {
+	if !strings.HasPrefix(p, "$tag") {
+		return label{path: p}, nil
+	}
+	l := label{fromTag: true, tagIndex: -1}
+	if rest := p[len("$tag"):]; rest != "" {
+		if len(rest) < 3 || rest[0] != '[' || rest[len(rest)-1] != ']' {
+			return l, fmt.Errorf("malformed tag reference: %s", p)
+		}
+		n, err := strconv.Atoi(rest[1 : len(rest)-1])
+		if err != nil || n < 0 {
+			return l, fmt.Errorf("malformed tag index: %s", p)
+		}
+		l.tagIndex = n
+	}
+	return l, nil
+}
+
+type Gauge struct {
+	Metric
+	*prometheus.GaugeVec
+	smooth *ewma
+	cache  *childCache
+}
+
+func newGauge(name string, m *Metric, reg prometheus.Registerer) (*Gauge, error) {
+	g := &Gauge{}
+	if m.Smoothing != "" {
+		var err error
+		if g.smooth, err = newEWMA(name, m); err != nil {
+			return nil, err
+		}
+		if m.expirer != nil {
+			m.expirer.forget = append(m.expirer.forget, g.smooth.forget)
+		}
+	}
+	vec := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: m.Help, ConstLabels: m.ConstLabels, Unit: m.Unit}, m.labelKeys)
+	c, err := registerShared(reg, vec)
+	if err != nil {
+		return nil, err
+	}
+	g.GaugeVec = c.(*prometheus.GaugeVec)
+	if m.ChildCacheSize > 0 {
+		g.cache = newChildCache(m.ChildCacheSize)
+	}
+	g.Metric = *m
+	return g, nil
+}
+
+func (g *Gauge) child(lvals []string) prometheus.Gauge {
+	if g.cache == nil {
+		return g.WithLabelValues(lvals...)
+	}
+	return g.cache.get(lvals, func() interface{} { return g.WithLabelValues(lvals...) }).(prometheus.Gauge)
+}
+
+func (g *Gauge) DeleteLabelValues(lvals ...string) bool {
+	if g.cache == nil {
+		return g.GaugeVec.DeleteLabelValues(lvals...)
+	}
+	return g.cache.delete(lvals, func() bool { return g.GaugeVec.DeleteLabelValues(lvals...) })
+}
+
+func (g *Gauge) HandleEvent(ev *event) error {
+	mode := g.GaugeMode
+	// Steps of a sampled gauge are scaled up like counter increments so that
+	// the level reflects all events, not just the sampled ones.
+	scale := 1.0
+	if g.sampler != nil {
+		scale = 1 / g.SampleRate
+	}
+	if mode == "inc" || mode == "dec" || (mode == "add" || mode == "sub") && g.Value.isEmpty() && g.expr == nil {
+		s := g.scratch()
+		defer g.release(s)
+		lvals, err := g.labelValues(ev, "", s)
+		if err != nil {
+			return err
+		}
+		if mode == "inc" || mode == "add" {
+			g.child(lvals).Add(scale)
+		} else {
+			g.child(lvals).Sub(scale)
+		}
+		return nil
+	}
+	return g.each(ev, func(v float64, lvals []string) error {
+		switch mode {
+		case "add":
+			g.child(lvals).Add(v * scale)
+		case "sub":
+			g.child(lvals).Sub(v * scale)
+		default:
+			if g.smooth != nil {
+				v = g.smooth.update(lvals, v)
+			}
+			g.child(lvals).Set(v)
+		}
+		return nil
+	})
+}
+
+type Counter struct {
+	Metric
+	*prometheus.CounterVec
+	deltas *deltaTracker
+	cache  *childCache
+	topk   *topkVec
+}
+
+func newCounter(name string, m *Metric, reg prometheus.Registerer) (*Counter, error) {
+	v := prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: m.Help, ConstLabels: m.ConstLabels, Unit: m.Unit}, m.labelKeys)
+	if m.TopK > 0 {
+		t := newTopKVec(v, m.TopK, len(m.labelKeys))
+		if err := reg.Register(t); err != nil {
+			return nil, err
+		}
+		c := &Counter{Metric: *m, CounterVec: v, topk: t}
+		if m.CountMode == "delta" {
+			c.deltas = newDeltaTracker()
+		}
+		return c, nil
+	}
+	shared, err := registerShared(reg, v)
+	if err != nil {
+		return nil, err
+	}
+	c := &Counter{Metric: *m, CounterVec: shared.(*prometheus.CounterVec)}
+	if m.ChildCacheSize > 0 {
+		c.cache = newChildCache(m.ChildCacheSize)
+	}
+	if m.CountMode == "delta" {
+		c.deltas = newDeltaTracker()
+		if m.expirer != nil {
+			m.expirer.forget = append(m.expirer.forget, c.deltas.forget)
+		}
+	}
+	return c, nil
+}
+
+func (g *Counter) HandleEvent(ev *event) error {
+	exemplar := g.exemplar(ev)
+	return g.count(ev, g.deltas, func(lvals []string, v float64) {
+		if g.topk != nil {
+			g.topk.add(lvals, v)
+			return
+		}
+		addWithExemplar(g.child(lvals), v, exemplar)
+	})
+}
+
+func (g *Counter) child(lvals []string) prometheus.Counter {
+	if g.cache == nil {
+		return g.WithLabelValues(lvals...)
+	}
+	return g.cache.get(lvals, func() interface{} { return g.WithLabelValues(lvals...) }).(prometheus.Counter)
+}
+
+func (g *Counter) DeleteLabelValues(lvals ...string) bool {
+	if g.topk != nil {
+		g.topk.forget(lvals)
+	}
+	if g.cache == nil {
+		return g.CounterVec.DeleteLabelValues(lvals...)
+	}
+	return g.cache.delete(lvals, func() bool { return g.CounterVec.DeleteLabelValues(lvals...) })
+}
+
+// count applies the event to a counter-like metric per count_mode, calling add
+// with the label values of the series and the increment.
+func (m *Metric) count(ev *event, deltas *deltaTracker, add func([]string, float64)) error {
+	if m.sampler != nil && m.CountMode != "delta" {
+		scale, inc := 1/m.SampleRate, add
+		add = func(lvals []string, v float64) { inc(lvals, v*scale) }
+	}
+	if m.Value.isEmpty() && m.expr == nil {
+		s := m.scratch()
+		defer m.release(s)
+		lvals, err := m.labelValues(ev, "", s)
+		if err != nil {
+			return err
+		}
+		add(lvals, 1)
+		return nil
+	}
+	if m.CountMode == "value" {
+		return m.each(ev, func(v float64, lvals []string) error {
+			if v < 0 {
+				switch m.NegativeAction {
+				case "skip":
+					m.st.samplesDropped.WithLabelValues(m.name, "negative").Inc()
+					return nil
+				case "clamp_zero":
+					v = 0
+				case "absolute":
+					v = -v
+				default:
+					return &handlerError{errNegativeCounter, errors.New("Counter value must be >=0")}
+				}
+			}
+			add(lvals, v)
+			return nil
+		})
+	}
+	if m.CountMode == "delta" {
+		return m.each(ev, func(v float64, lvals []string) error {
+			if v < 0 {
+				return &handlerError{errNegativeCounter, errors.New("Cumulative counter value must be >=0")}
+			}
+			add(lvals, deltas.delta(lvals, v))
+			return nil
+		})
+	}
+	switch m.CountMode {
+	case "match", "not_match":
+		return m.countMatch(ev, add)
+	case "gt", "ge", "lt", "le", "eq", "ne":
+		return m.countThreshold(ev, add)
+	}
+	s := m.scratch()
+	defer m.release(s)
+	for _, e := range m.values {
+		lvals, err := m.labelValues(ev, e.key, s)
+		if err == errSkip {
+			continue
+		} else if err != nil {
+			return err
+		}
+		_, found, err := m.lookup(ev, e.path)
+		if err != nil {
+			return err
+		}
+		if m.CountMode == "exist" && found || m.CountMode == "non_exist" && !found {
+			add(lvals, 1)
+		} else {
+			add(lvals, 0)
+		}
+	}
+	return nil
+}
+
+// countMatch counts the event if the value matches pattern, or does not match
+// it for count_mode = "not_match". A missing value is never counted.
+func (m *Metric) countMatch(ev *event, add func([]string, float64)) error {
+	s := m.scratch()
+	defer m.release(s)
+	for _, e := range m.values {
+		raw, found, err := m.lookup(ev, e.path)
+		if err != nil {
+			return err
+		}
+		var inc float64
+		if found {
+			var s string
+			switch v := raw.(type) {
+			case string:
+				s = v
+			case []byte:
+				s = string(v)
+			default:
+				return &handlerError{errTypeMismatch, fmt.Errorf("%s: cannot match %T against pattern", e.path, raw)}
+			}
+			if m.patternRe.MatchString(s) == (m.CountMode == "match") {
+				inc = 1
+			}
+		}
+		lvals, err := m.labelValues(ev, e.key, s)
+		if err == errSkip {
+			continue
+		} else if err != nil {
+			return err
+		}
+		add(lvals, inc)
+	}
+	return nil
+}
+
+// countThreshold counts the event if the value compared with threshold per
+// count_mode is true. A missing value is never counted.
+func (m *Metric) countThreshold(ev *event, add func([]string, float64)) error {
+	s := m.scratch()
+	defer m.release(s)
+	for _, e := range m.values {
+		raw, found, err := m.lookup(ev, e.path)
+		if err != nil {
+			return err
+		}
+		var inc float64
+		if found {
+			v, err := m.convert(raw, e.path)
+			if err != nil {
+				return err
+			}
+			if compare(m.CountMode, m.transform(v), *m.Threshold) {
+				inc = 1
+			}
+		}
+		lvals, err := m.labelValues(ev, e.key, s)
+		if err == errSkip {
+			continue
+		} else if err != nil {
+			return err
+		}
+		add(lvals, inc)
+	}
+	return nil
+}
+
+func compare(op CountMode, v, threshold float64) bool {
+	switch op {
+	case "gt":
+		return v > threshold
+	case "ge":
+		return v >= threshold
+	case "lt":
+		return v < threshold
+	case "le":
+		return v <= threshold
+	case "eq":
+		return v == threshold
+	}
+	return v != threshold
+}
+
+type Histogram struct {
+	Metric
+	*prometheus.HistogramVec
+}
+
+func newHistogram(name string, m *Metric, reg prometheus.Registerer) (*Histogram, error) {
+	if m.Buckets == nil {
+		m.Buckets = prometheus.DefBuckets
+	}
+	if len(m.Buckets) == 0 {
+		return nil, fmt.Errorf("Histogram %s must have at least one bucket", name)
+	}
+	for i := 1; i < len(m.Buckets); i++ {
+		if m.Buckets[i] <= m.Buckets[i-1] {
+			return nil, fmt.Errorf("Histogram %s buckets must be in increasing order", name)
+		}
+	}
+	v := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:        name,
+		Help:        m.Help,
+		ConstLabels: m.ConstLabels,
+		Unit:        m.Unit,
+		Buckets:     m.Buckets,
+	}, m.labelKeys)
+	shared, err := registerShared(reg, v)
+	if err != nil {
+		return nil, err
+	}
+	return &Histogram{Metric: *m, HistogramVec: shared.(*prometheus.HistogramVec)}, nil
+}
+
+func (h *Histogram) HandleEvent(ev *event) error {
+	exemplar := h.exemplar(ev)
+	return h.each(ev, func(v float64, lvals []string) error {
+		observeWithExemplar(h.WithLabelValues(lvals...), v, exemplar)
+		return nil
+	})
+}
+
+type Summary struct {
+	Metric
+	*prometheus.SummaryVec
+}
+
+func newSummary(name string, m *Metric, reg prometheus.Registerer) (*Summary, error) {
+	objectives := defaultObjectives
+	if len(m.Objectives) > 0 {
+		objectives = make(map[float64]float64)
+		for k, e := range m.Objectives {
+			q, err := strconv.ParseFloat(k, 64)
+			if err != nil || q < 0 || q > 1 {
+				return nil, fmt.Errorf("Summary %s has invalid quantile %q (e.g. \"0.5\" = 0.05, \"0.9\" = 0.01, \"0.99\" = 0.001)", name, k)
+			}
+			objectives[q] = e
+		}
+	}
+	v := prometheus.NewSummaryVec(prometheus.SummaryOpts{
+		Name:        name,
+		Help:        m.Help,
+		ConstLabels: m.ConstLabels,
+		Unit:        m.Unit,
+		Objectives:  objectives,
+		MaxAge:      m.MaxAge.Duration,
+		AgeBuckets:  m.AgeBuckets,
+	}, m.labelKeys)
+	shared, err := registerShared(reg, v)
+	if err != nil {
+		return nil, err
+	}
+	return &Summary{Metric: *m, SummaryVec: shared.(*prometheus.SummaryVec)}, nil
+}
+
+func (s *Summary) HandleEvent(ev *event) error {
+	return s.each(ev, func(v float64, lvals []string) error {
+		s.WithLabelValues(lvals...).Observe(v)
+		return nil
+	})
+}
+
+type OutPrometheus struct {
+	lastEvent  int64 // unix nano, accessed atomically; first for alignment
+	env        *plugin.Env
+	conf       Config
+	servers    []*http.Server
+	addrs      []net.Addr
+	registry   *prometheus.Registry
+	collectors *collectorSet
+	stats      *stats
+	handlers   atomic.Value // *handlerSet
+	reloadMu   sync.Mutex
+	stop       chan struct{}
+	sweepStop  chan struct{}
+	pool       *workerPool
+	tags       *tagCounter
+	logs       *logThrottle
+	ctx        context.Context
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
+	ready      int32 // accessed atomically
+}
+
+func (p *OutPrometheus) Init(env *plugin.Env) error {
+	p.env = env
+	if err := env.ReadConfig(&p.conf); err != nil {
+		return err
+	}
+	return p.conf.resolve()
+}
+
+// Start builds the metrics and starts exposing them. If any step fails, what
+// has been set up so far is released so that Start can be retried.
+func (p *OutPrometheus) Start() (err error) {
+	defer func() {
+		if err != nil {
+			p.Close()
+		}
+	}()
+	p.registry = prometheus.NewRegistry()
+	p.collectors = newCollectorSet(p.registry)
+	// include_go_metrics is the former switch of both the collectors.
+	if p.conf.CollectGoMetrics || p.conf.IncludeGoMetrics {
+		if err = p.collectors.Register(collectors.NewGoCollector()); err != nil {
+			return
+		}
+	}
+	if p.conf.CollectProcessMetrics || p.conf.IncludeGoMetrics {
+		if err = p.collectors.Register(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{})); err != nil {
+			return
+		}
+	}
+	p.stats = newStats()
+	if err = p.stats.register(p.collectors); err != nil {
+		return
+	}
+	p.logs = newLogThrottle(p.conf.LogThrottleInterval.Duration)
+	if p.conf.BuiltinTagCounter {
+		p.tags = newTagCounter(p.conf.TagCounterDepth, p.conf.TagCounterMaxTags, p.conf.TagCounterOtherTag)
+		if err = p.collectors.Register(p.tags.vec); err != nil {
+			return
+		}
+	}
+	metrics := p.conf.effectiveMetrics()
+	if err = checkNames(metrics); err != nil {
+		return
+	}
+	if err = checkWorkerPolicies(p.conf.Workers, metrics); err != nil {
+		return
+	}
+	handlers, err := p.buildHandlers(metrics, p.collectors)
+	if err != nil {
+		return
+	}
+	if p.conf.StateFile != "" {
+		if err = p.restoreState(handlers); err != nil {
+			return fmt.Errorf("Failed to restore state: %v", err)
+		}
+	}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	if err = p.startHandlers(handlers); err != nil {
+		return
+	}
+	p.handlers.Store(newHandlerSet(handlers, metrics))
+	p.stats.configuredMetrics.Set(float64(len(handlers)))
+	p.pool = nil
+	if p.conf.Workers > 0 {
+		p.pool = newWorkerPool(p, p.conf.Workers, p.conf.QueueSize, p.conf.QueueFullAction == "drop")
+	}
+	p.stop = make(chan struct{})
+	p.restartSweeper()
+	if p.conf.PushgatewayURL != "" {
+		if err = p.startPush(); err != nil {
+			return
+		}
+	} else if !p.conf.Listen.empty() || p.conf.SocketActivation || p.conf.TextfilePath == "" {
+		if err = p.serve(); err != nil {
+			return
+		}
+	}
+	if p.conf.TextfilePath != "" {
+		p.startTextfile()
+	}
+	if p.conf.StateFile != "" {
+		p.startState()
+	}
+	if p.conf.GraphiteAddress != "" {
+		if err = p.startGraphite(); err != nil {
+			return
+		}
+	}
+	atomic.StoreInt64(&p.lastEvent, time.Now().UnixNano())
+	atomic.StoreInt32(&p.ready, 1)
+	return nil
+}
+
+// buildHandlers creates the handlers of the metrics in the order of their
+// names, registering them with reg. The error refers to the config key of the
+// failed metric.
+func (p *OutPrometheus) buildHandlers(metrics map[string]Metric, reg *collectorSet) ([]Handler, error) {
+	keys := make([]string, 0, len(metrics))
+	for name := range metrics {
+		keys = append(keys, name)
+	}
+	sort.Strings(keys)
+	var handlers []Handler
+	built := make(map[string]string)
+	for _, name := range keys {
+		metric := metrics[name]
+		fq := metric.fqName(name)
+		own := newCollectorSet(reg)
+		h, err := metric.New(name, own, p.stats)
+		if err != nil {
+			if key, ok := built[fq]; ok {
+				return nil, fmt.Errorf("metrics.%s: cannot share %s with metrics.%s: %v", name, fq, key, err)
+			}
+			return nil, fmt.Errorf("metrics.%s: %v", name, err)
+		}
+		if _, ok := built[fq]; !ok {
+			built[fq] = name
+		}
+		reg.own(h, own.collectors)
+		handlers = append(handlers, h)
+	}
+	return handlers, nil
+}
+
+// startHandlers starts the handlers. On failure the ones already started are
+// closed.
+func (p *OutPrometheus) startHandlers(handlers []Handler) error {
+	for i, h := range handlers {
+		if err := h.Start(p.ctx); err != nil {
+			p.closeHandlers(handlers[:i])
+			return fmt.Errorf("metrics.%s: %v", h.metricName(), err)
+		}
+	}
+	return nil
+}
+
+// closeHandlers closes the handlers, waiting for their goroutines to stop.
+func (p *OutPrometheus) closeHandlers(handlers []Handler) {
+	for _, h := range handlers {
+		if err := h.Close(); err != nil {
+			p.env.Log.Errorf("Failed to close metrics.%s: %v", h.metricName(), err)
+		}
+	}
+}
+
+// handled is returned by Encode for every event. The events are fully
+// processed in Encode, so a single zero-size item is shared instead of
+// allocating one per event.
+var handled buffer.Sizer = buffer.StringItem("")
+
+// Encode applies the event to every matching handler. Handler errors are
+// handled per the on_error policy of the metric; the first error of a metric
+// with the "fail" policy is returned after all handlers ran.
+func (p *OutPrometheus) Encode(ev *message.Event) (buffer.Sizer, error) {
+	p.stats.eventsReceived.Inc()
+	if p.tags != nil {
+		p.tags.inc(ev.Tag)
+	}
+	if p.pool != nil {
+		p.pool.dispatch(ev, p.matchHandlers(ev.Tag))
+		return handled, nil
+	}
+	handlers := p.matchHandlers(ev.Tag)
+	var failed error
+	ok := true
+	x := &jsonExpander{ev: event{Event: ev}, now: time.Now()}
+	if len(handlers) > 1 {
+		x.ev.x = newExtraction(p.stats.paths.len())
+		defer x.ev.x.release()
+	}
+	for _, h := range handlers {
+		if err := p.process(h, x); err != nil {
+			ok = false
+			if h.errorPolicy() == "fail" && failed == nil {
+				failed = err
+			}
+		}
+	}
+	if failed != nil {
+		return nil, failed
+	}
+	if ok {
+		p.processed(x.now)
+	}
+	return handled, nil
+}
+
+// process applies the event of x to the handler. The error is counted and
+// logged according to the error policy; errors the policy asks to fail on
+// are left to the caller.
+func (p *OutPrometheus) process(h Handler, x *jsonExpander) error {
+	e, err := x.expand(h.jsonFields())
+	if err == nil {
+		err = p.handle(h, e)
+	}
+	for _, path := range h.unmatchedPaths() {
+		p.env.Log.Warningf("metrics.%s: %s has not matched any event so far; check the path for typos", h.metricName(), path)
+	}
+	if err == nil {
+		h.consumed(x.now)
+		return nil
+	}
+	if err == errSkip {
+		return nil
+	}
+	p.stats.handlerErrors.WithLabelValues(h.metricName(), errorKind(err)).Inc()
+	if h.errorPolicy() == "log" {
+		p.logError(h, err)
+	}
+	return err
+}
+
+// processed records that an event received at now was processed without
+// errors.
+func (p *OutPrometheus) processed(now time.Time) {
+	p.stats.lastEvent.Set(float64(now.UnixNano()) / 1e9)
+	atomic.StoreInt64(&p.lastEvent, now.UnixNano())
+}
+
+// handle applies the event to the handler unless it is filtered out or not
+// sampled. An event matching delete_when deletes the series instead.
+func (p *OutPrometheus) handle(h Handler, ev *event) error {
+	if !h.MatchRecord(ev) {
+		return errSkip
+	}
+	if deleted, err := h.tombstone(ev); deleted {
+		return err
+	}
+	if !h.sample() {
+		return errSkip
+	}
+	return h.HandleEvent(ev)
+}
+
+func (p *OutPrometheus) Write(l []buffer.Sizer) (int, error) {
+	return len(l), nil
+}
+
+func (p *OutPrometheus) Close() (err error) {
+	atomic.StoreInt32(&p.ready, 0)
+	if p.servers != nil {
+		err = p.shutdown()
+		p.servers = nil
+		p.addrs = nil
+		if p.conf.PortFile != "" {
+			os.Remove(p.conf.PortFile)
+		}
+	}
+	if p.sweepStop != nil {
+		close(p.sweepStop)
+		p.sweepStop = nil
+	}
+	if p.pool != nil {
+		p.pool.close()
+	}
+	if p.cancel != nil {
+		p.cancel()
+		p.closeHandlers(p.loadHandlers())
+		p.cancel = nil
+	}
+	if p.stop != nil {
+		close(p.stop)
+		p.wg.Wait()
+		p.stop = nil
+	}
+	if p.collectors != nil {
+		p.collectors.unregisterAll()
+	}
+	p.handlers.Store(&handlerSet{})
+	return
+}
@@ -0,0 +1,330 @@
+package outprom
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/yosisa/fluxion/log"
+	"github.com/yosisa/fluxion/message"
+	"github.com/yosisa/fluxion/plugin"
+)
+
+// decodeMetric decodes the TOML body of a single metric definition.
+func decodeMetric(t testing.TB, src string) Metric {
+	t.Helper()
+	var conf struct{ Metrics map[string]Metric }
+	if _, err := toml.Decode("[metrics.test]\n"+src, &conf); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	return conf.Metrics["test"]
+}
+
+// newTestHandler creates the handler of a metric named "test" on a private
+// registry.
+func newTestHandler(t testing.TB, src string) (Handler, *prometheus.Registry) {
+	t.Helper()
+	m := decodeMetric(t, src)
+	reg := prometheus.NewRegistry()
+	h, err := m.New("test", reg, nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return h, reg
+}
+
+// newTestPlugin returns a plugin with the handlers of the metrics started, to
+// which events can be passed with Encode.
+func newTestPlugin(t testing.TB, metrics map[string]Metric) *OutPrometheus {
+	t.Helper()
+	p := &OutPrometheus{stats: newStats(), ctx: context.Background()}
+	handlers, err := p.buildHandlers(metrics, newCollectorSet(prometheus.NewRegistry()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.startHandlers(handlers); err != nil {
+		t.Fatal(err)
+	}
+	p.handlers.Store(newHandlerSet(handlers, metrics))
+	return p
+}
+
+// newTestEnv returns an env reading the plugin config from the TOML src.
+func newTestEnv(src string) *plugin.Env {
+	return &plugin.Env{
+		Name: "out-prometheus",
+		ReadConfig: func(v interface{}) error {
+			_, err := toml.Decode(src, v)
+			return err
+		},
+		Emit: func(*message.Event) {},
+		Log:  &log.Logger{},
+	}
+}
+
+// startPlugin initializes and starts the plugin with the TOML config src,
+// closing it at the end of the test.
+func startPlugin(t testing.TB, src string) *OutPrometheus {
+	t.Helper()
+	p := &OutPrometheus{}
+	if err := p.Init(newTestEnv(src)); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	if err := p.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func newEvent(tag string, record map[string]interface{}) *event {
+	return &event{Event: &message.Event{Tag: tag, Time: time.Now(), Record: record}}
+}
+
+// assertMetrics compares the gathered metrics against the text exposition
+// format, without HELP and TYPE lines.
+func assertMetrics(t testing.TB, reg prometheus.Gatherer, want string, names ...string) {
+	t.Helper()
+	var b strings.Builder
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	for _, mf := range mfs {
+		if len(names) == 0 || contains(names, mf.GetName()) {
+			b.WriteString("# HELP " + mf.GetName() + " " + mf.GetHelp() + "\n")
+			b.WriteString("# TYPE " + mf.GetName() + " " + strings.ToLower(mf.GetType().String()) + "\n")
+		}
+	}
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(b.String()+trimIndent(want)), names...); err != nil {
+		t.Error(err)
+	}
+}
+
+func contains(a []string, s string) bool {
+	for _, x := range a {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+func trimIndent(s string) string {
+	var b strings.Builder
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			b.WriteString(line + "\n")
+		}
+	}
+	return b.String()
+}
+
+func handle(t testing.TB, h Handler, ev *event) {
+	t.Helper()
+	if err := h.HandleEvent(ev); err != nil {
+		t.Fatalf("HandleEvent: %v", err)
+	}
+}
+
+func TestGauge(t *testing.T) {
+	h, reg := newTestHandler(t, `
+type = "gauge"
+value = "size"
+labels = { host = "host" }
+`)
+	handle(t, h, newEvent("t", map[string]interface{}{"size": 10.0, "host": "a"}))
+	handle(t, h, newEvent("t", map[string]interface{}{"size": 3.0, "host": "a"}))
+	handle(t, h, newEvent("t", map[string]interface{}{"size": 5.0, "host": "b"}))
+	assertMetrics(t, reg, `
+test{host="a"} 3
+test{host="b"} 5
+`)
+}
+
+func TestGaugeModeSampled(t *testing.T) {
+	for _, tt := range []struct {
+		mode  string
+		value string
+		want  string
+	}{
+		{"inc", "", `test 4`},
+		{"dec", "", `test -4`},
+		{"add", "size", `test 12`},
+		{"sub", "size", `test -12`},
+	} {
+		t.Run(tt.mode, func(t *testing.T) {
+			h, reg := newTestHandler(t, `
+type = "gauge"
+gauge_mode = "`+tt.mode+`"
+value = "`+tt.value+`"
+sample_rate = 0.5
+`)
+			// HandleEvent is only called for sampled events, so every call
+			// stands for 1/sample_rate events.
+			handle(t, h, newEvent("t", map[string]interface{}{"size": 2.0}))
+			handle(t, h, newEvent("t", map[string]interface{}{"size": 4.0}))
+			assertMetrics(t, reg, tt.want)
+		})
+	}
+}
+
+func TestCounter(t *testing.T) {
+	h, reg := newTestHandler(t, `
+type = "counter"
+value = "count"
+`)
+	handle(t, h, newEvent("t", map[string]interface{}{"count": 2.0}))
+	handle(t, h, newEvent("t", map[string]interface{}{"count": 3.0}))
+	assertMetrics(t, reg, `test 5`)
+}
+
+func TestCounterRejectsNegative(t *testing.T) {
+	h, _ := newTestHandler(t, `
+type = "counter"
+value = "count"
+`)
+	if err := h.HandleEvent(newEvent("t", map[string]interface{}{"count": -1.0})); err == nil {
+		t.Error("HandleEvent succeeded with a negative increment")
+	}
+}
+
+func TestNewRejectsUnknownType(t *testing.T) {
+	var conf struct{ Metrics map[string]Metric }
+	if _, err := toml.Decode("[metrics.test]\ntype = \"bogus\"\n", &conf); err == nil {
+		t.Error("Decode succeeded with an unknown metric type")
+	}
+}
+
+func TestEncodeSharesItem(t *testing.T) {
+	p := newTestPlugin(t, map[string]Metric{"test": decodeMetric(t, `type = "counter"`)})
+	a, err := p.Encode(&message.Event{Tag: "t", Record: map[string]interface{}{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := p.Encode(&message.Event{Tag: "u", Record: map[string]interface{}{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != handled || b != handled || a.Size() != 0 {
+		t.Errorf("Encode returned %v and %v, want the shared zero-size item", a, b)
+	}
+}
+
+// BenchmarkEncode reports the allocations per event through Encode, for a
+// single unlabelled counter.
+func BenchmarkEncode(b *testing.B) {
+	p := newTestPlugin(b, map[string]Metric{"test": decodeMetric(b, "type = \"counter\"\nvalue = \"n\"\n")})
+	ev := &message.Event{Tag: "t", Record: map[string]interface{}{"n": 1.0}}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := p.Encode(ev); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// TestStartCloseRestart checks that Close releases every collector, so that
+// the plugin can be started again with the same config.
+func TestStartCloseRestart(t *testing.T) {
+	p := startPlugin(t, `
+listen = "127.0.0.1:0"
+builtin_tag_counter = true
+collect_go_metrics = true
+
+[metrics.hits]
+type = "counter"
+labels = { vhost = "vhost" }
+`)
+	for i := 0; i < 3; i++ {
+		if _, err := p.Encode(&message.Event{Tag: "t", Record: map[string]interface{}{"vhost": "a"}}); err != nil {
+			t.Fatal(err)
+		}
+		assertMetrics(t, p.registry, `hits{vhost="a"} 1`, "hits")
+		reg := p.registry
+		if err := p.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+		if mfs, err := reg.Gather(); err != nil || len(mfs) != 0 {
+			t.Errorf("%d metric families left registered after Close: %v", len(mfs), err)
+		}
+		if p.Addrs() != nil {
+			t.Errorf("still bound to %v after Close", p.Addrs())
+		}
+		if err := p.Start(); err != nil {
+			t.Fatalf("Start #%d: %v", i+2, err)
+		}
+	}
+}
+
+// lifecycleHandler records the calls of Start and Close.
+type lifecycleHandler struct {
+	Handler
+	name     string
+	startErr error
+	ctx      context.Context
+	started  int
+	closed   int
+}
+
+func (h *lifecycleHandler) metricName() string { return h.name }
+
+func (h *lifecycleHandler) exactTag() (string, bool) { return h.name, true }
+
+func (h *lifecycleHandler) Start(ctx context.Context) error {
+	h.started++
+	h.ctx = ctx
+	return h.startErr
+}
+
+func (h *lifecycleHandler) Close() error {
+	h.closed++
+	return nil
+}
+
+func TestHandlerLifecycle(t *testing.T) {
+	p := &OutPrometheus{env: newTestEnv("")}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	a, b := &lifecycleHandler{name: "a"}, &lifecycleHandler{name: "b"}
+	if err := p.startHandlers([]Handler{a, b}); err != nil {
+		t.Fatal(err)
+	}
+	p.handlers.Store(newHandlerSet([]Handler{a, b}, nil))
+	if a.started != 1 || b.started != 1 || a.ctx != p.ctx {
+		t.Errorf("started %d and %d times", a.started, b.started)
+	}
+	ctx := p.ctx
+	p.Close()
+	if a.closed != 1 || b.closed != 1 {
+		t.Errorf("closed %d and %d times", a.closed, b.closed)
+	}
+	if ctx.Err() == nil {
+		t.Error("ctx of the handlers is not done after Close")
+	}
+	// A second Close does not close the handlers again.
+	p.Close()
+	if a.closed != 1 || b.closed != 1 {
+		t.Errorf("closed %d and %d times after closing twice", a.closed, b.closed)
+	}
+}
+
+func TestHandlerLifecycleStartFailure(t *testing.T) {
+	p := &OutPrometheus{env: newTestEnv(""), ctx: context.Background()}
+	a := &lifecycleHandler{name: "a"}
+	b := &lifecycleHandler{name: "b", startErr: errors.New("boom")}
+	c := &lifecycleHandler{name: "c"}
+	err := p.startHandlers([]Handler{a, b, c})
+	if err == nil || err.Error() != "metrics.b: boom" {
+		t.Fatalf("err = %v", err)
+	}
+	// The handlers started before the failing one are closed, and the
+	// later ones are never started.
+	if a.closed != 1 || b.closed != 0 || c.started != 0 {
+		t.Errorf("a closed %d, b closed %d, c started %d times", a.closed, b.closed, c.started)
+	}
+}
@@ -0,0 +1,252 @@
+package outprom
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// fieldPath is a parsed record path. Each step is either a map key, an array
+// index, or the wildcard [*] standing for every element of an array.
+type fieldPath []pathStep
+
+type pathStep struct {
+	key      string
+	index    int
+	isKey    bool
+	wildcard bool
+}
+
+// parsePath parses a slash-separated path such as "/a/b[0]". A leading slash
+// is optional and empty parts are ignored. A key containing a slash or a
+// bracket is either double-quoted, as in /"a/b"/c, or has these characters
+// escaped by a backslash, as in /a\/b/c. At most one index may be the
+// wildcard [*], as in /disks[*]/used.
+func parsePath(p string) (fieldPath, error) {
+	var fp fieldPath
+	wildcard := false
+	for i := 0; i < len(p); {
+		if p[i] == '/' {
+			i++
+			continue
+		}
+		if p[i] == '"' {
+			end := strings.IndexByte(p[i+1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quote in path %q", p)
+			}
+			fp = append(fp, pathStep{key: p[i+1 : i+1+end], isKey: true})
+			i += end + 2
+		} else if p[i] != '[' {
+			var key []byte
+			for ; i < len(p) && p[i] != '/' && p[i] != '['; i++ {
+				if p[i] == '\\' {
+					if i++; i == len(p) {
+						return nil, fmt.Errorf("trailing backslash in path %q", p)
+					}
+				}
+				key = append(key, p[i])
+			}
+			fp = append(fp, pathStep{key: string(key), isKey: true})
+		}
+		for i < len(p) && p[i] == '[' {
+			end := strings.IndexByte(p[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated index in path %q", p)
+			}
+			if p[i+1:i+end] == "*" {
+				if wildcard {
+					return nil, fmt.Errorf("multiple wildcards in path %q", p)
+				}
+				wildcard = true
+				fp = append(fp, pathStep{wildcard: true})
+				i += end + 1
+				continue
+			}
+			n, err := strconv.Atoi(p[i+1 : i+end])
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid index %q in path %q", p[i+1:i+end], p)
+			}
+			fp = append(fp, pathStep{index: n})
+			i += end + 1
+		}
+		if i < len(p) && p[i] != '/' {
+			return nil, fmt.Errorf("unexpected %q in path %q", p[i], p)
+		}
+	}
+	return fp, nil
+}
+
+// walk returns the value at the path of v, or false if it does not exist.
+// Besides maps keyed by strings, it navigates maps decoded from msgpack which
+// are keyed by interface{}; their keys which are not strings, such as
+// integers, are matched by their string form.
+func (fp fieldPath) walk(v interface{}) (interface{}, bool) {
+	if len(fp) == 0 {
+		return nil, false
+	}
+	return fp.walkFrom(v)
+}
+
+// walkFrom is walk relative to v, returning v itself for the empty path. A
+// wildcard step never matches; use elements for paths having one.
+func (fp fieldPath) walkFrom(v interface{}) (interface{}, bool) {
+	var ok bool
+	for _, s := range fp {
+		if s.wildcard {
+			return nil, false
+		}
+		if s.isKey {
+			if v, ok = lookupKey(v, s.key); !ok {
+				return nil, false
+			}
+			continue
+		}
+		a, ok := v.([]interface{})
+		if !ok || s.index >= len(a) {
+			return nil, false
+		}
+		v = a[s.index]
+	}
+	return v, true
+}
+
+// hasWildcard reports whether the path has the wildcard step.
+func (fp fieldPath) hasWildcard() bool {
+	for _, s := range fp {
+		if s.wildcard {
+			return true
+		}
+	}
+	return false
+}
+
+// elements returns the array the wildcard of the path refers to and the rest
+// of the path to be walked from each element. false is returned if the array
+// does not exist.
+func (fp fieldPath) elements(v interface{}) ([]interface{}, fieldPath, bool) {
+	for i, s := range fp {
+		if !s.wildcard {
+			continue
+		}
+		x, ok := fp[:i].walk(v)
+		if !ok {
+			return nil, nil, false
+		}
+		a, ok := x.([]interface{})
+		return a, fp[i+1:], ok
+	}
+	return nil, nil, false
+}
+
+func lookupKey(v interface{}, key string) (interface{}, bool) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		x, ok := t[key]
+		return x, ok
+	case map[interface{}]interface{}:
+		return lookupAnyKey(t, key)
+	case map[string]string:
+		x, ok := t[key]
+		return x, ok
+	}
+	return nil, false
+}
+
+// lookupAnyKey looks key up in a map keyed by interface{}, matching the keys
+// by their string form as toString formats them. Rather than scanning the
+// map, it looks up each key of a type whose string form key can be, so a
+// missing key costs a few lookups at most.
+func lookupAnyKey(m map[interface{}]interface{}, key string) (interface{}, bool) {
+	if x, ok := m[key]; ok {
+		return x, true
+	}
+	if key == "" {
+		x, ok := m[nil]
+		return x, ok
+	}
+	if b, err := strconv.ParseBool(key); err == nil && strconv.FormatBool(b) == key {
+		x, ok := m[b]
+		return x, ok
+	}
+	if n, err := strconv.ParseInt(key, 10, 64); err == nil && strconv.FormatInt(n, 10) == key {
+		if x, ok := lookupInt(m, n); ok {
+			return x, true
+		}
+	} else if u, err := strconv.ParseUint(key, 10, 64); err == nil && strconv.FormatUint(u, 10) == key {
+		if x, ok := m[u]; ok {
+			return x, true
+		}
+		if x, ok := m[uint(u)]; ok && uint64(uint(u)) == u {
+			return x, true
+		}
+	}
+	if f, err := strconv.ParseFloat(key, 64); err == nil {
+		if strconv.FormatFloat(f, 'f', -1, 64) == key {
+			if x, ok := m[f]; ok {
+				return x, true
+			}
+		}
+		if f32 := float32(f); strconv.FormatFloat(float64(f32), 'f', -1, 32) == key {
+			if x, ok := m[f32]; ok {
+				return x, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// lookupInt looks n up as each integer type able to hold it.
+func lookupInt(m map[interface{}]interface{}, n int64) (interface{}, bool) {
+	if x, ok := m[n]; ok {
+		return x, true
+	}
+	if int64(int(n)) == n {
+		if x, ok := m[int(n)]; ok {
+			return x, true
+		}
+	}
+	if int64(int32(n)) == n {
+		if x, ok := m[int32(n)]; ok {
+			return x, true
+		}
+	}
+	if int64(int16(n)) == n {
+		if x, ok := m[int16(n)]; ok {
+			return x, true
+		}
+	}
+	if int64(int8(n)) == n {
+		if x, ok := m[int8(n)]; ok {
+			return x, true
+		}
+	}
+	if n < 0 {
+		return nil, false
+	}
+	if x, ok := m[uint64(n)]; ok {
+		return x, true
+	}
+	if uint64(uint(n)) == uint64(n) {
+		if x, ok := m[uint(n)]; ok {
+			return x, true
+		}
+	}
+	if n <= math.MaxUint32 {
+		if x, ok := m[uint32(n)]; ok {
+			return x, true
+		}
+	}
+	if n <= math.MaxUint16 {
+		if x, ok := m[uint16(n)]; ok {
+			return x, true
+		}
+	}
+	if n <= math.MaxUint8 {
+		if x, ok := m[uint8(n)]; ok {
+			return x, true
+		}
+	}
+	return nil, false
+}
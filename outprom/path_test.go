@@ -0,0 +1,133 @@
+package outprom
+
+import "testing"
+
+func TestLookupAnyKey(t *testing.T) {
+	m := map[interface{}]interface{}{
+		"name":          "s",
+		int64(1):        "int64",
+		int8(-2):        "int8",
+		uint16(3):       "uint16",
+		uint64(1 << 63): "uint64",
+		true:            "bool",
+		1.5:             "float64",
+		float32(2.25):   "float32",
+		nil:             "nil",
+	}
+	tests := []struct {
+		key  string
+		want interface{}
+	}{
+		{"name", "s"},
+		{"1", "int64"},
+		{"-2", "int8"},
+		{"3", "uint16"},
+		{"9223372036854775808", "uint64"},
+		{"true", "bool"},
+		{"1.5", "float64"},
+		{"2.25", "float32"},
+		{"", "nil"},
+		{"missing", nil},
+		{"01", nil},
+		{"+1", nil},
+		{"t", nil},
+		{"1.50", nil},
+	}
+	for _, tt := range tests {
+		got, ok := lookupKey(m, tt.key)
+		if ok != (tt.want != nil) || got != tt.want {
+			t.Errorf("lookupKey(%q) = %v, %v, want %v", tt.key, got, ok, tt.want)
+		}
+		// The keyed lookups must agree with matching the string form of
+		// every key.
+		var scanned interface{}
+		for k, x := range m {
+			if s, ok := toString(k); ok && s == tt.key {
+				scanned = x
+			}
+		}
+		if scanned != tt.want {
+			t.Errorf("scan of %q = %v, want %v", tt.key, scanned, tt.want)
+		}
+	}
+}
+
+// TestMsgpackMaps checks that paths walk maps decoded from msgpack, whose
+// keys are interface{} and whose strings may be []byte.
+func TestMsgpackMaps(t *testing.T) {
+	h, reg := newTestHandler(t, `
+type = "counter"
+value = "res/bytes"
+labels = { vhost = "req/vhost", code = "res/codes/200" }
+`)
+	handle(t, h, newEvent("t", map[string]interface{}{
+		"req": map[interface{}]interface{}{"vhost": []byte("example.com")},
+		"res": map[interface{}]interface{}{
+			"bytes": uint64(512),
+			"codes": map[interface{}]interface{}{int64(200): "ok"},
+		},
+	}))
+	assertMetrics(t, reg, `test{code="ok",vhost="example.com"} 512`)
+}
+
+var nestedRecord = map[string]interface{}{
+	"bytes": 512.0,
+	"req": map[string]interface{}{
+		"vhost":   "example.com",
+		"method":  "GET",
+		"headers": map[string]interface{}{"ua": "curl"},
+	},
+	"res": map[string]interface{}{"status": "200", "upstream": []interface{}{map[string]interface{}{"addr": "10.0.0.1"}}},
+}
+
+var nestedPaths = []string{"req/vhost", "req/method", "req/headers/ua", "res/status", "res/upstream[0]/addr"}
+
+// BenchmarkWalk compares walking the 5 nested label paths precompiled
+// against parsing them for every lookup.
+func BenchmarkWalk(b *testing.B) {
+	fps := make([]fieldPath, len(nestedPaths))
+	for i, p := range nestedPaths {
+		fp, err := parsePath(p)
+		if err != nil {
+			b.Fatal(err)
+		}
+		fps[i] = fp
+	}
+	b.Run("precompiled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, fp := range fps {
+				if _, ok := fp.walk(nestedRecord); !ok {
+					b.Fatal("not found")
+				}
+			}
+		}
+	})
+	b.Run("parsed", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, p := range nestedPaths {
+				fp, _ := parsePath(p)
+				if _, ok := fp.walk(nestedRecord); !ok {
+					b.Fatal("not found")
+				}
+			}
+		}
+	})
+}
+
+// BenchmarkNestedLabels measures a counter labelled by the 5 nested paths.
+func BenchmarkNestedLabels(b *testing.B) {
+	h, _ := newTestHandler(b, `
+type = "counter"
+value = "bytes"
+labels = { vhost = "req/vhost", method = "req/method", ua = "req/headers/ua", status = "res/status", upstream = "res/upstream[0]/addr" }
+`)
+	ev := newEvent("t", nestedRecord)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := h.HandleEvent(ev); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package outprom
+
+import "sync/atomic"
+
+const defaultUnmatchedPathEvents = 1000
+
+// pathWatch notices value and label paths that have not matched any record
+// after a number of lookups, which is almost always a typo in the config.
+type pathWatch struct {
+	after   int64
+	paths   map[string]*watchedPath
+	pending int32
+}
+
+type watchedPath struct {
+	misses   int64
+	matched  int32
+	reported int32
+}
+
+func newPathWatch(after int, paths []string) *pathWatch {
+	if after == 0 {
+		after = defaultUnmatchedPathEvents
+	}
+	if after < 0 {
+		return nil
+	}
+	w := &pathWatch{after: int64(after), paths: make(map[string]*watchedPath)}
+	for _, p := range paths {
+		w.paths[p] = &watchedPath{}
+	}
+	return w
+}
+
+func (w *pathWatch) observe(p string, found bool) {
+	wp, ok := w.paths[p]
+	if !ok || atomic.LoadInt32(&wp.matched) == 1 {
+		return
+	}
+	if found {
+		atomic.StoreInt32(&wp.matched, 1)
+		return
+	}
+	if atomic.AddInt64(&wp.misses, 1) == w.after {
+		atomic.StoreInt32(&w.pending, 1)
+	}
+}
+
+// unmatched returns the paths which have newly reached the threshold without
+// a match. Each path is returned only once.
+func (w *pathWatch) unmatched() []string {
+	if !atomic.CompareAndSwapInt32(&w.pending, 1, 0) {
+		return nil
+	}
+	var paths []string
+	for p, wp := range w.paths {
+		if atomic.LoadInt32(&wp.matched) == 0 && atomic.LoadInt64(&wp.misses) >= w.after &&
+			atomic.CompareAndSwapInt32(&wp.reported, 0, 1) {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
@@ -0,0 +1,177 @@
+package outprom
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultPercentileWindow = 5 * time.Minute
+	defaultReservoirSize    = 512
+	percentileSlots         = 5
+)
+
+// percentileVec is a collector of gauges which export quantiles of the values
+// observed over a sliding window. The window is divided into slots, each of
+// which keeps a fixed-size uniform sample of its observations, so the memory
+// used per series is bounded. A series disappears once its window is empty.
+type percentileVec struct {
+	desc       *prometheus.Desc
+	quantiles  []float64
+	labels     []string
+	size       int
+	resolution int64
+	rand       *rand.Rand
+	mu         sync.Mutex
+	series     map[string]*percentileSeries
+}
+
+type percentileSeries struct {
+	values []string
+	slots  [percentileSlots]reservoir
+}
+
+// reservoir is a uniform sample of the observations within a slot.
+type reservoir struct {
+	slot   int64
+	count  int
+	sample []float64
+}
+
+func newPercentileVec(name string, m *Metric) (*percentileVec, error) {
+	if len(m.Quantiles) == 0 {
+		return nil, fmt.Errorf("quantiles of %s is required by type = \"percentiles\"", name)
+	}
+	p := &percentileVec{
+		quantiles: append([]float64(nil), m.Quantiles...),
+		size:      m.ReservoirSize,
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		series:    make(map[string]*percentileSeries),
+	}
+	sort.Float64s(p.quantiles)
+	for _, q := range p.quantiles {
+		if q < 0 || q > 1 {
+			return nil, fmt.Errorf("Quantile of %s must be in [0, 1]: %v", name, q)
+		}
+		p.labels = append(p.labels, strconv.FormatFloat(q, 'g', -1, 64))
+	}
+	if p.size == 0 {
+		p.size = defaultReservoirSize
+	}
+	window := m.Window.Duration
+	if window == 0 {
+		window = defaultPercentileWindow
+	}
+	if p.resolution = int64(window / percentileSlots); p.resolution == 0 {
+		p.resolution = 1
+	}
+	keys := append(append([]string(nil), m.labelKeys...), "quantile")
+	p.desc = m.newDesc(name, keys)
+	return p, nil
+}
+
+func (p *percentileVec) observe(lvals []string, v float64) {
+	key := seriesKey(lvals)
+	slot := time.Now().UnixNano() / p.resolution
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.series[key]
+	if !ok {
+		s = &percentileSeries{values: append([]string(nil), lvals...)}
+		p.series[key] = s
+	}
+	r := &s.slots[slot%percentileSlots]
+	if r.slot != slot {
+		r.slot, r.count, r.sample = slot, 0, r.sample[:0]
+	}
+	r.count++
+	if len(r.sample) < p.size {
+		r.sample = append(r.sample, v)
+	} else if i := p.rand.Intn(r.count); i < p.size {
+		r.sample[i] = v
+	}
+}
+
+type weighted struct {
+	v, w float64
+}
+
+func (p *percentileVec) Describe(ch chan<- *prometheus.Desc) {
+	ch <- p.desc
+}
+
+func (p *percentileVec) Collect(ch chan<- prometheus.Metric) {
+	slot := time.Now().UnixNano() / p.resolution
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, s := range p.series {
+		var obs []weighted
+		var total float64
+		for _, r := range s.slots {
+			if r.slot <= slot-percentileSlots || r.count == 0 {
+				continue
+			}
+			// Each sampled value stands for count/len(sample) observations.
+			w := float64(r.count) / float64(len(r.sample))
+			for _, v := range r.sample {
+				obs = append(obs, weighted{v, w})
+			}
+			total += float64(r.count)
+		}
+		if len(obs) == 0 {
+			delete(p.series, key)
+			continue
+		}
+		sort.Slice(obs, func(i, j int) bool { return obs[i].v < obs[j].v })
+		lvals := append(s.values[:len(s.values):len(s.values)], "")
+		j, acc := 0, obs[0].w
+		for i, q := range p.quantiles {
+			for rank := q * total; acc < rank && j < len(obs)-1; acc += obs[j].w {
+				j++
+			}
+			lvals[len(lvals)-1] = p.labels[i]
+			ch <- prometheus.MustNewConstMetric(p.desc, prometheus.GaugeValue, obs[j].v, lvals...)
+		}
+	}
+}
+
+func (p *percentileVec) DeleteLabelValues(lvals ...string) bool {
+	key := seriesKey(lvals)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.series[key]
+	delete(p.series, key)
+	return ok
+}
+
+// Percentiles is a gauge of quantiles of the values over a sliding window.
+// Unlike a summary, the quantiles are computed by the exporter and labeled by
+// quantile as separate gauges.
+type Percentiles struct {
+	Metric
+	*percentileVec
+}
+
+func newPercentiles(name string, m *Metric, reg prometheus.Registerer) (*Percentiles, error) {
+	v, err := newPercentileVec(name, m)
+	if err != nil {
+		return nil, err
+	}
+	if err := reg.Register(v); err != nil {
+		return nil, err
+	}
+	return &Percentiles{Metric: *m, percentileVec: v}, nil
+}
+
+func (p *Percentiles) HandleEvent(ev *event) error {
+	return p.each(ev, func(v float64, lvals []string) error {
+		p.observe(lvals, v)
+		return nil
+	})
+}
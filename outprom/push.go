@@ -0,0 +1,48 @@
+package outprom
+
+import (
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+const defaultPushInterval = 15 * time.Second
+
+// startPush starts pushing the registry to the Pushgateway periodically. A
+// final push is made when the plugin is stopped.
+func (p *OutPrometheus) startPush() error {
+	if p.conf.Job == "" {
+		return errors.New("job is required to push metrics to the Pushgateway")
+	}
+	pusher := push.New(p.conf.PushgatewayURL, p.conf.Job).Gatherer(p.registry)
+	for k, v := range p.conf.Grouping {
+		pusher = pusher.Grouping(k, v)
+	}
+	interval := p.conf.PushInterval.Duration
+	if interval == 0 {
+		interval = defaultPushInterval
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.push(pusher)
+			case <-p.stop:
+				p.push(pusher)
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (p *OutPrometheus) push(pusher *push.Pusher) {
+	if err := pusher.Push(); err != nil {
+		p.env.Log.Errorf("Failed to push metrics: %v", err)
+	}
+}
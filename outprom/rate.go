@@ -0,0 +1,122 @@
+package outprom
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultRateWindow = time.Minute
+	rateBuckets       = 60
+)
+
+// rateVec is a collector of gauges which export the per-second rate of the
+// counted events over a sliding window. The window is divided into a fixed
+// number of buckets, so the memory used per series is bounded.
+type rateVec struct {
+	desc       *prometheus.Desc
+	window     time.Duration
+	resolution int64
+	mu         sync.Mutex
+	series     map[string]*rateSeries
+}
+
+type rateSeries struct {
+	values  []string
+	buckets [rateBuckets]rateBucket
+}
+
+type rateBucket struct {
+	slot int64
+	sum  float64
+}
+
+func newRateVec(name string, m *Metric) *rateVec {
+	window := m.RateWindow.Duration
+	if window == 0 {
+		window = defaultRateWindow
+	}
+	resolution := int64(window / rateBuckets)
+	if resolution == 0 {
+		resolution = 1
+	}
+	return &rateVec{
+		desc:       m.newDesc(name, m.labelKeys),
+		window:     window,
+		resolution: resolution,
+		series:     make(map[string]*rateSeries),
+	}
+}
+
+func (r *rateVec) add(lvals []string, v float64) {
+	key := seriesKey(lvals)
+	slot := time.Now().UnixNano() / r.resolution
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.series[key]
+	if !ok {
+		s = &rateSeries{values: append([]string(nil), lvals...)}
+		r.series[key] = s
+	}
+	b := &s.buckets[slot%rateBuckets]
+	if b.slot != slot {
+		b.slot, b.sum = slot, 0
+	}
+	b.sum += v
+}
+
+func (r *rateVec) Describe(ch chan<- *prometheus.Desc) {
+	ch <- r.desc
+}
+
+func (r *rateVec) Collect(ch chan<- prometheus.Metric) {
+	slot := time.Now().UnixNano() / r.resolution
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range r.series {
+		var sum float64
+		for _, b := range s.buckets {
+			if b.slot > slot-rateBuckets {
+				sum += b.sum
+			}
+		}
+		ch <- prometheus.MustNewConstMetric(r.desc, prometheus.GaugeValue, sum/r.window.Seconds(), s.values...)
+	}
+}
+
+func (r *rateVec) DeleteLabelValues(lvals ...string) bool {
+	key := seriesKey(lvals)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.series[key]
+	delete(r.series, key)
+	return ok
+}
+
+// Rate is a gauge of the per-second rate of events counted per count_mode.
+type Rate struct {
+	Metric
+	*rateVec
+	deltas *deltaTracker
+}
+
+func newRate(name string, m *Metric, reg prometheus.Registerer) (*Rate, error) {
+	v := newRateVec(name, m)
+	if err := reg.Register(v); err != nil {
+		return nil, err
+	}
+	r := &Rate{Metric: *m, rateVec: v}
+	if m.CountMode == "delta" {
+		r.deltas = newDeltaTracker()
+		if m.expirer != nil {
+			m.expirer.forget = append(m.expirer.forget, r.deltas.forget)
+		}
+	}
+	return r, nil
+}
+
+func (r *Rate) HandleEvent(ev *event) error {
+	return r.count(ev, r.deltas, r.add)
+}
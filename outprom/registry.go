@@ -0,0 +1,138 @@
+package outprom
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// collectorSet is a prometheus.Registerer which remembers the collectors it
+// registered so that they can be unregistered all at once. It also remembers
+// which handler registered which collectors, as a handler is not necessarily
+// the collector registered for it.
+type collectorSet struct {
+	reg        prometheus.Registerer
+	mu         sync.Mutex
+	collectors []prometheus.Collector
+	owned      map[Handler][]prometheus.Collector
+}
+
+func newCollectorSet(reg prometheus.Registerer) *collectorSet {
+	return &collectorSet{reg: reg}
+}
+
+func (s *collectorSet) Register(c prometheus.Collector) error {
+	if err := s.reg.Register(c); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.collectors = append(s.collectors, c)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *collectorSet) MustRegister(cs ...prometheus.Collector) {
+	for _, c := range cs {
+		if err := s.Register(c); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func (s *collectorSet) Unregister(c prometheus.Collector) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, x := range s.collectors {
+		if x == c {
+			s.collectors = append(s.collectors[:i], s.collectors[i+1:]...)
+			break
+		}
+	}
+	return s.reg.Unregister(c)
+}
+
+// registerShared registers c with reg. If a collector of the same kind with
+// the same descriptors is registered already, e.g. by another metric
+// definition of the same name, that collector is returned instead so that
+// both definitions update it.
+func registerShared(reg prometheus.Registerer, c prometheus.Collector) (prometheus.Collector, error) {
+	if err := reg.Register(c); err != nil {
+		are, ok := err.(prometheus.AlreadyRegisteredError)
+		if !ok {
+			return nil, err
+		}
+		if reflect.TypeOf(are.ExistingCollector) != reflect.TypeOf(c) {
+			return nil, errors.New("registered already by another type of metric")
+		}
+		return are.ExistingCollector, nil
+	}
+	return c, nil
+}
+
+// own records the collectors registered for h.
+func (s *collectorSet) own(h Handler, cs []prometheus.Collector) {
+	s.mu.Lock()
+	if s.owned == nil {
+		s.owned = make(map[Handler][]prometheus.Collector)
+	}
+	s.owned[h] = append(s.owned[h], cs...)
+	s.mu.Unlock()
+}
+
+// adopt takes over the ownership recorded in other.
+func (s *collectorSet) adopt(other *collectorSet) {
+	other.mu.Lock()
+	owned := other.owned
+	other.owned = nil
+	other.mu.Unlock()
+	for h, cs := range owned {
+		s.own(h, cs)
+	}
+}
+
+// transfer hands the collectors of from over to to, which keeps using them.
+func (s *collectorSet) transfer(from, to Handler) {
+	s.mu.Lock()
+	if cs, ok := s.owned[from]; ok {
+		delete(s.owned, from)
+		s.owned[to] = append(s.owned[to], cs...)
+	}
+	s.mu.Unlock()
+}
+
+// unregisterHandler unregisters the collectors of h and returns them so that
+// they can be registered again with registerHandler.
+func (s *collectorSet) unregisterHandler(h Handler) []prometheus.Collector {
+	s.mu.Lock()
+	cs := s.owned[h]
+	delete(s.owned, h)
+	s.mu.Unlock()
+	for _, c := range cs {
+		s.Unregister(c)
+	}
+	return cs
+}
+
+func (s *collectorSet) registerHandler(h Handler, cs []prometheus.Collector) error {
+	for _, c := range cs {
+		if err := s.Register(c); err != nil {
+			return err
+		}
+	}
+	s.own(h, cs)
+	return nil
+}
+
+// unregisterAll unregisters every collector registered through the set in
+// the reverse order of registration.
+func (s *collectorSet) unregisterAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := len(s.collectors) - 1; i >= 0; i-- {
+		s.reg.Unregister(s.collectors[i])
+	}
+	s.collectors = nil
+	s.owned = nil
+}
@@ -0,0 +1,70 @@
+package outprom
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestCollectorSetHandlerOwnership(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	set := newCollectorSet(reg)
+	p := &OutPrometheus{stats: newStats()}
+	metrics := map[string]Metric{
+		"hits": decodeMetric(t, `
+type = "counter"
+value = "count"
+labels = { path = "path" }
+topk = 1
+`),
+	}
+	handlers, err := p.buildHandlers(metrics, set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := handlers[0]
+	cs := set.unregisterHandler(h)
+	if len(cs) != 1 {
+		t.Fatalf("unregisterHandler returned %d collectors, want 1", len(cs))
+	}
+	if _, ok := cs[0].(*topkVec); !ok {
+		t.Fatalf("owned collector is %T, want *topkVec", cs[0])
+	}
+	if mfs, _ := reg.Gather(); len(mfs) != 0 {
+		t.Fatalf("%d families left after unregisterHandler", len(mfs))
+	}
+	if err := set.registerHandler(h, cs); err != nil {
+		t.Fatal(err)
+	}
+	handle(t, h, newEvent("t", map[string]interface{}{"count": 1.0, "path": "/a"}))
+	handle(t, h, newEvent("t", map[string]interface{}{"count": 5.0, "path": "/b"}))
+	assertMetrics(t, reg, `
+hits{path="/b"} 5
+hits{path="_other"} 1
+`)
+}
+
+func TestCollectorSetSharedCollector(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	set := newCollectorSet(reg)
+	p := &OutPrometheus{stats: newStats()}
+	def := decodeMetric(t, `
+type = "counter"
+value = "count"
+`)
+	handlers, err := p.buildHandlers(map[string]Metric{"shared": def}, set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	more, err := p.buildHandlers(map[string]Metric{"shared": def}, set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs := set.unregisterHandler(more[0]); len(cs) != 0 {
+		t.Errorf("sharing handler owns %d collectors, want 0", len(cs))
+	}
+	set.transfer(handlers[0], more[0])
+	if cs := set.unregisterHandler(more[0]); len(cs) != 1 {
+		t.Errorf("handler owns %d collectors after transfer, want 1", len(cs))
+	}
+}
@@ -0,0 +1,303 @@
+package outprom
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// handlerSet is the immutable list of handlers used by Encode, which is
+// replaced as a whole on reload.
+type handlerSet struct {
+	handlers     []Handler
+	metrics      map[string]Metric
+	fingerprints map[string]string
+	dispatch     *dispatcher
+}
+
+func newHandlerSet(handlers []Handler, metrics map[string]Metric) *handlerSet {
+	return &handlerSet{
+		handlers:     handlers,
+		metrics:      metrics,
+		fingerprints: fingerprints(metrics),
+		dispatch:     newDispatcher(handlers),
+	}
+}
+
+func (p *OutPrometheus) loadHandlers() []Handler {
+	if s, ok := p.handlers.Load().(*handlerSet); ok {
+		return s.handlers
+	}
+	return nil
+}
+
+// matchHandlers returns the handlers whose tag pattern matches the tag.
+func (p *OutPrometheus) matchHandlers(tag string) []Handler {
+	if s, ok := p.handlers.Load().(*handlerSet); ok && s.dispatch != nil {
+		return s.dispatch.match(tag)
+	}
+	return nil
+}
+
+// effectiveMetrics returns the metrics of the config with the plugin-wide
+// defaults applied.
+func (c *Config) effectiveMetrics() map[string]Metric {
+	metrics := make(map[string]Metric, len(c.Metrics))
+	for name, metric := range c.Metrics {
+		if metric.MissingLabelAction == "" {
+			metric.MissingLabelAction = c.MissingLabelAction
+			metric.MissingLabelDefault = c.MissingLabelDefault
+		}
+		if metric.SanitizeLabels == nil {
+			metric.SanitizeLabels = c.SanitizeLabels
+		}
+		if metric.CollapseWhitespace == nil {
+			metric.CollapseWhitespace = c.CollapseWhitespace
+		}
+		if metric.MaxLabelLength == 0 {
+			metric.MaxLabelLength = c.MaxLabelLength
+		}
+		if metric.EnforceNaming == nil {
+			metric.EnforceNaming = c.EnforceNaming
+		}
+		if metric.UnmatchedPathEvents == 0 {
+			metric.UnmatchedPathEvents = c.UnmatchedPathEvents
+		}
+		if metric.Namespace == "" {
+			metric.Namespace = c.Namespace
+		}
+		if metric.Subsystem == "" {
+			metric.Subsystem = c.Subsystem
+		}
+		metrics[name] = metric
+	}
+	shareHelp(metrics)
+	return metrics
+}
+
+// shareHelp gives the metrics sharing a name the same help, which the
+// registry requires. The first help set explicitly in the order of the keys
+// is used.
+func shareHelp(metrics map[string]Metric) {
+	keys := make([]string, 0, len(metrics))
+	for name := range metrics {
+		keys = append(keys, name)
+	}
+	sort.Strings(keys)
+	groups := make(map[string][]string)
+	for _, name := range keys {
+		m := metrics[name]
+		fq := m.fqName(name)
+		groups[fq] = append(groups[fq], name)
+	}
+	for _, names := range groups {
+		if len(names) < 2 {
+			continue
+		}
+		help := "{name} generated by fluxion out-prometheus from events"
+		for _, name := range names {
+			if h := metrics[name].Help; h != "" {
+				help = h
+				break
+			}
+		}
+		for _, name := range names {
+			m := metrics[name]
+			if m.Help == "" {
+				m.Help = help
+				metrics[name] = m
+			}
+		}
+	}
+}
+
+// fingerprint identifies the definition of a metric as configured, so that a
+// reload can tell whether it changed.
+func fingerprint(m Metric) string {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+func fingerprints(metrics map[string]Metric) map[string]string {
+	fps := make(map[string]string, len(metrics))
+	for name, m := range metrics {
+		fps[name] = fingerprint(m)
+	}
+	return fps
+}
+
+// reload re-reads the config and applies the changes of the metrics. New
+// metrics are registered, removed ones are unregistered and changed ones are
+// re-created; unchanged metrics keep their state. On failure the previous set
+// of handlers stays in effect.
+func (p *OutPrometheus) reload() error {
+	p.reloadMu.Lock()
+	defer p.reloadMu.Unlock()
+	var conf Config
+	if err := p.env.ReadConfig(&conf); err != nil {
+		return err
+	}
+	if err := conf.resolve(); err != nil {
+		return err
+	}
+	metrics := conf.effectiveMetrics()
+	if err := checkNames(metrics); err != nil {
+		return err
+	}
+	if err := checkWorkerPolicies(p.conf.Workers, metrics); err != nil {
+		return err
+	}
+	fps := fingerprints(metrics)
+	old, _ := p.handlers.Load().(*handlerSet)
+	if old == nil {
+		return fmt.Errorf("Plugin is not started")
+	}
+
+	keep := make(map[string]Handler)
+	var stale []Handler
+	for _, h := range old.handlers {
+		name := h.metricName()
+		if fp, ok := fps[name]; ok && fp == old.fingerprints[name] {
+			keep[name] = h
+		} else {
+			stale = append(stale, h)
+		}
+	}
+	added := make(map[string]Metric)
+	for name, m := range metrics {
+		if _, ok := keep[name]; !ok {
+			added[name] = m
+		}
+	}
+
+	// A collector shared with a metric kept as is stays registered.
+	inUse := make(map[string]Handler)
+	for name, h := range keep {
+		m := metrics[name]
+		inUse[m.fqName(name)] = h
+	}
+	unregistered := make(map[Handler][]prometheus.Collector)
+	for _, h := range stale {
+		m := old.metrics[h.metricName()]
+		if _, ok := inUse[m.fqName(h.metricName())]; !ok {
+			unregistered[h] = p.collectors.unregisterHandler(h)
+		}
+	}
+	tmp := newCollectorSet(p.collectors)
+	built, err := p.buildHandlers(added, tmp)
+	if err == nil {
+		err = p.startHandlers(built)
+	}
+	if err != nil {
+		tmp.unregisterAll()
+		for h, cs := range unregistered {
+			p.collectors.registerHandler(h, cs)
+		}
+		return err
+	}
+	p.collectors.adopt(tmp)
+	for _, h := range stale {
+		m := old.metrics[h.metricName()]
+		if keeper, ok := inUse[m.fqName(h.metricName())]; ok {
+			p.collectors.transfer(h, keeper)
+		}
+	}
+
+	handlers := built
+	for _, h := range keep {
+		handlers = append(handlers, h)
+	}
+	sort.Slice(handlers, func(i, j int) bool { return handlers[i].metricName() < handlers[j].metricName() })
+	p.handlers.Store(newHandlerSet(handlers, metrics))
+	p.closeHandlers(stale)
+	p.conf.Metrics = conf.Metrics
+	p.stats.configuredMetrics.Set(float64(len(handlers)))
+	p.restartSweeper()
+	changed := 0
+	for _, h := range stale {
+		if _, ok := metrics[h.metricName()]; ok {
+			changed++
+		} else {
+			p.stats.forget(h.metricName())
+		}
+	}
+	p.env.Log.Infof("Reloaded metrics: %d added, %d changed, %d removed", len(added)-changed, changed, len(stale)-changed)
+	return nil
+}
+
+var shareable = map[MetricType]bool{"gauge": true, "counter": true, "histogram": true, "summary": true}
+
+// checkNames returns an error if metrics which cannot share a collector have
+// the same name.
+func checkNames(metrics map[string]Metric) error {
+	keys := make([]string, 0, len(metrics))
+	for name := range metrics {
+		keys = append(keys, name)
+	}
+	sort.Strings(keys)
+	names := make(map[string]string)
+	for _, name := range keys {
+		metric := metrics[name]
+		if key, ok := names[metric.fqName(name)]; ok {
+			// Metrics of the same name and type share the collector,
+			// e.g. to count events of different shapes. Whether the
+			// labels match is checked on registration.
+			if metric.Type == metrics[key].Type {
+				if shareable[metric.Type] {
+					continue
+				}
+				return fmt.Errorf("Metrics %s and %s have the same name %s but type %s cannot be shared", key, name, metric.fqName(name), metric.Type)
+			}
+			return fmt.Errorf("Metrics %s and %s have the same name %s but different types", key, name, metric.fqName(name))
+		}
+		names[metric.fqName(name)] = name
+	}
+	return nil
+}
+
+// restartSweeper (re)starts the goroutine expiring series of the current
+// handlers.
+func (p *OutPrometheus) restartSweeper() {
+	if p.sweepStop != nil {
+		close(p.sweepStop)
+		p.sweepStop = nil
+	}
+	var expirers []*seriesExpirer
+	for _, h := range p.loadHandlers() {
+		if e := h.expiry(); e != nil && e.ttl > 0 {
+			expirers = append(expirers, e)
+		}
+	}
+	if len(expirers) == 0 {
+		return
+	}
+	stop := make(chan struct{})
+	p.sweepStop = stop
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		sweeper(expirers, stop)
+	}()
+}
+
+func (p *OutPrometheus) reloadHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := p.reload(); err != nil {
+			p.env.Log.Errorf("Failed to reload: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(w, "OK")
+	})
+}
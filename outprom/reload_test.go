@@ -0,0 +1,32 @@
+package outprom
+
+import (
+	"testing"
+
+	"github.com/yosisa/fluxion/message"
+)
+
+// TestReloadKeepsUnchangedFilteredMetric checks that compiling the filters
+// leaves the parsed config alone, so that reloading the same config keeps
+// the state of the metric.
+func TestReloadKeepsUnchangedFilteredMetric(t *testing.T) {
+	p := startPlugin(t, `
+[metrics.hits]
+type = "counter"
+filters = [{ path = "count", op = "exists" }]
+delete_when = [{ path = "gone", op = "exists" }]
+`)
+	for i := 0; i < 2; i++ {
+		if _, err := p.Encode(&message.Event{Tag: "t", Record: map[string]interface{}{"count": 1.0}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := p.loadHandlers()[0]
+	if err := p.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if p.loadHandlers()[0] != before {
+		t.Error("unchanged metric was re-created on reload")
+	}
+	assertMetrics(t, p.registry, `hits 2`, "hits")
+}
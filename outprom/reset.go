@@ -0,0 +1,129 @@
+package outprom
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// resetVec is a collector of gauges which accumulate values and are reset to
+// zero when reported. With reset = "on_scrape" every scrape reports the sum
+// since the previous scrape; with reset_interval a scrape reports the sum of
+// the last completed interval, which spans until the first scrape after the
+// interval elapsed. The accumulators are swapped atomically so that
+// no increment is lost during a scrape.
+type resetVec struct {
+	desc     *prometheus.Desc
+	interval time.Duration
+	mu       sync.RWMutex
+	series   map[string]*resetSeries
+}
+
+type resetSeries struct {
+	values []string
+	cur    uint64 // float64 bits
+	done   float64
+	start  time.Time
+}
+
+func (s *resetSeries) add(v float64) {
+	for {
+		old := atomic.LoadUint64(&s.cur)
+		if atomic.CompareAndSwapUint64(&s.cur, old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (s *resetSeries) swap() float64 {
+	return math.Float64frombits(atomic.SwapUint64(&s.cur, 0))
+}
+
+func (r *resetVec) add(lvals []string, v float64) {
+	key := seriesKey(lvals)
+	r.mu.RLock()
+	s, ok := r.series[key]
+	r.mu.RUnlock()
+	if !ok {
+		r.mu.Lock()
+		if s, ok = r.series[key]; !ok {
+			s = &resetSeries{values: append([]string(nil), lvals...), start: time.Now()}
+			r.series[key] = s
+		}
+		r.mu.Unlock()
+	}
+	s.add(v)
+}
+
+func (r *resetVec) Describe(ch chan<- *prometheus.Desc) {
+	ch <- r.desc
+}
+
+func (r *resetVec) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range r.series {
+		var v float64
+		if r.interval == 0 {
+			v = s.swap()
+		} else {
+			if now.Sub(s.start) >= r.interval {
+				s.done = s.swap()
+				s.start = now
+			}
+			v = s.done
+		}
+		ch <- prometheus.MustNewConstMetric(r.desc, prometheus.GaugeValue, v, s.values...)
+	}
+}
+
+func (r *resetVec) DeleteLabelValues(lvals ...string) bool {
+	key := seriesKey(lvals)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.series[key]
+	delete(r.series, key)
+	return ok
+}
+
+// ResetCounter is a counter which is reset when reported, exposed as a gauge
+// as it is not monotonic.
+type ResetCounter struct {
+	Metric
+	*resetVec
+	deltas *deltaTracker
+}
+
+func newResetCounter(name string, m *Metric, reg prometheus.Registerer) (*ResetCounter, error) {
+	if m.Reset != "" && m.Reset != "on_scrape" {
+		return nil, fmt.Errorf("Unknown reset of %s: %s", name, m.Reset)
+	}
+	if m.Reset != "" && m.ResetInterval.Duration > 0 {
+		return nil, fmt.Errorf("reset and reset_interval of %s are exclusive", name)
+	}
+	v := &resetVec{
+		desc:     m.newDesc(name, m.labelKeys),
+		interval: m.ResetInterval.Duration,
+		series:   make(map[string]*resetSeries),
+	}
+	if err := reg.Register(v); err != nil {
+		return nil, err
+	}
+	c := &ResetCounter{Metric: *m, resetVec: v}
+	if m.CountMode == "delta" {
+		c.deltas = newDeltaTracker()
+		if m.expirer != nil {
+			m.expirer.forget = append(m.expirer.forget, c.deltas.forget)
+		}
+	}
+	return c, nil
+}
+
+func (c *ResetCounter) HandleEvent(ev *event) error {
+	return c.count(ev, c.deltas, c.add)
+}
@@ -0,0 +1,34 @@
+package outprom
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// sampler selects events with a fixed probability. It is a splitmix64
+// generator advanced atomically so that concurrent callers never contend on a
+// lock.
+type sampler struct {
+	state     uint64
+	threshold uint64
+}
+
+func newSampler(rate float64) *sampler {
+	return &sampler{
+		state:     uint64(time.Now().UnixNano()),
+		threshold: uint64(rate * math.MaxUint64),
+	}
+}
+
+func (s *sampler) next() uint64 {
+	z := atomic.AddUint64(&s.state, 0x9e3779b97f4a7c15)
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+// sample reports whether the event should be processed.
+func (s *sampler) sample() bool {
+	return s.next() < s.threshold
+}
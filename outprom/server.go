@@ -0,0 +1,559 @@
+package outprom
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/yosisa/fluxion/plugin"
+)
+
+const defaultShutdownTimeout = 5 * time.Second
+
+// serve starts the HTTP server exposing the registry.
+func (p *OutPrometheus) serve() error {
+	if p.conf.Path == "" {
+		p.conf.Path = "/metrics"
+	}
+	if !strings.HasPrefix(p.conf.Path, "/") {
+		return fmt.Errorf("Path must start with /: %s", p.conf.Path)
+	}
+	metrics, reload, config, landing, series := p.metricsHandler(), p.reloadHandler(), p.configHandler(), p.landingHandler(), p.seriesHandler()
+	healthy, ready := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "OK")
+	}), p.readyHandler()
+
+	listeners := p.conf.listeners()
+	lns := make([]net.Listener, 0, len(listeners))
+	servers := make([]*http.Server, 0, len(listeners))
+	closeAll := func() {
+		for _, ln := range lns {
+			ln.Close()
+		}
+	}
+	for _, l := range listeners {
+		mux := http.NewServeMux()
+		mux.Handle(p.conf.Path, l.withAuth(metrics))
+		// Anyone able to reach an unauthenticated listener could reload,
+		// so the endpoint needs credentials or an explicit admin_api.
+		if p.conf.AdminAPI || l.hasAuth() {
+			mux.Handle("/-/reload", l.withAuth(reload))
+		}
+		mux.Handle("/-/healthy", healthy)
+		mux.Handle("/-/ready", ready)
+		mux.Handle("/-/config", l.withAuth(config))
+		if p.conf.AdminAPI {
+			mux.Handle("/-/series", l.withAuth(series))
+		}
+		mux.Handle("/", l.withAuth(landing))
+		handler, err := p.withAllowlist(mux)
+		if err != nil {
+			closeAll()
+			return err
+		}
+		tlsConf, err := l.tlsConfig()
+		if err != nil {
+			closeAll()
+			return err
+		}
+		ln, err := p.listenWithRetry(&l)
+		if err != nil {
+			closeAll()
+			return fmt.Errorf("Failed to listen on %s: %v", l.Address, err)
+		}
+		if tlsConf != nil {
+			ln = tls.NewListener(ln, tlsConf)
+		}
+		lns = append(lns, ln)
+		servers = append(servers, &http.Server{Handler: handler})
+	}
+	addrs := make([]net.Addr, len(lns))
+	for i, ln := range lns {
+		addrs[i] = ln.Addr()
+		p.env.Log.Infof("Listening on %s", addrs[i])
+	}
+	if p.conf.PortFile != "" {
+		if err := writePortFile(p.conf.PortFile, addrs); err != nil {
+			closeAll()
+			return fmt.Errorf("Failed to write port_file: %v", err)
+		}
+	}
+	for i, server := range servers {
+		go server.Serve(lns[i])
+	}
+	p.servers = servers
+	p.addrs = addrs
+	return nil
+}
+
+// Addrs returns the addresses the HTTP server is bound to, which tells the
+// port chosen when listening on port 0. nil is returned unless serving.
+func (p *OutPrometheus) Addrs() []net.Addr {
+	return p.addrs
+}
+
+// writePortFile writes the port of each TCP address, or the address itself
+// for the others, one per line. The file is replaced atomically.
+func writePortFile(path string, addrs []net.Addr) error {
+	var b strings.Builder
+	for _, addr := range addrs {
+		if a, ok := addr.(*net.TCPAddr); ok {
+			fmt.Fprintln(&b, a.Port)
+		} else {
+			fmt.Fprintln(&b, addr)
+		}
+	}
+	return writeFileAtomic(path, []byte(b.String()))
+}
+
+type ErrorHandling string
+
+func (e *ErrorHandling) UnmarshalText(b []byte) error {
+	s := string(b)
+	switch s {
+	case "continue", "http_error":
+		*e = ErrorHandling(s)
+		return nil
+	}
+	return fmt.Errorf("Unknown error_handling: %s", s)
+}
+
+// metricsHandler returns the handler serving the registry. Errors during
+// gathering are logged and, unless error_handling is "http_error", the
+// metrics gathered successfully are still served.
+func (p *OutPrometheus) metricsHandler() http.Handler {
+	opts := promhttp.HandlerOpts{
+		ErrorLog:           promLogger{p.env},
+		ErrorHandling:      promhttp.ContinueOnError,
+		DisableCompression: p.conf.DisableCompression,
+		// Exemplars are only exposed in the OpenMetrics format.
+		EnableOpenMetrics:   p.conf.OpenMetrics || p.conf.hasExemplars(),
+		MaxRequestsInFlight: p.conf.MaxRequestsInFlight,
+	}
+	if p.conf.ErrorHandling == "http_error" {
+		opts.ErrorHandling = promhttp.HTTPErrorOnError
+	}
+	// The handler selects the metric families with name[] like the
+	// federation endpoint of Prometheus.
+	h := promhttp.HandlerFor(p.registry, opts)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout := scrapeTimeout(r, p.conf.ScrapeTimeout.Duration)
+		if timeout == 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		http.TimeoutHandler(h, timeout, "Gathering metrics timed out").ServeHTTP(w, r)
+	})
+}
+
+// scrapeTimeout returns the timeout of the scrape request, the smaller of
+// max and the scrape timeout Prometheus tells in the
+// X-Prometheus-Scrape-Timeout-Seconds header. The latter is shortened a bit
+// so that Prometheus receives the error rather than timing out itself. 0
+// means no timeout.
+func scrapeTimeout(r *http.Request, max time.Duration) time.Duration {
+	v := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds")
+	if v == "" {
+		return max
+	}
+	sec, err := strconv.ParseFloat(v, 64)
+	if err != nil || sec <= 0 {
+		return max
+	}
+	if d := time.Duration(sec * 0.9 * float64(time.Second)); max == 0 || d < max {
+		return d
+	}
+	return max
+}
+
+func (c *Config) hasExemplars() bool {
+	for _, m := range c.Metrics {
+		if len(m.ExemplarLabels) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// promLogger adapts the plugin logger to promhttp.Logger.
+type promLogger struct {
+	env *plugin.Env
+}
+
+func (l promLogger) Println(v ...interface{}) {
+	l.env.Log.Error(v...)
+}
+
+// readyHandler reports whether the plugin is started and, if
+// max_event_silence is set, an event has been processed recently.
+func (p *OutPrometheus) readyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&p.ready) == 0 {
+			http.Error(w, "Not ready", http.StatusServiceUnavailable)
+			return
+		}
+		if max := p.conf.MaxEventSilence.Duration; max > 0 {
+			last := time.Unix(0, atomic.LoadInt64(&p.lastEvent))
+			if silence := time.Since(last); silence > max {
+				http.Error(w, fmt.Sprintf("No event processed for %v", silence.Truncate(time.Second)), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		fmt.Fprintln(w, "OK")
+	})
+}
+
+// shutdown stops the HTTP servers, waiting for in-flight requests up to
+// shutdown_timeout.
+func (p *OutPrometheus) shutdown() (err error) {
+	timeout := p.conf.ShutdownTimeout.Duration
+	if timeout == 0 {
+		timeout = defaultShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, server := range p.servers {
+		if e := server.Shutdown(ctx); e != nil {
+			if e = server.Close(); e != nil && err == nil {
+				err = e
+			}
+		}
+	}
+	return
+}
+
+const (
+	defaultBindBackoff    = 500 * time.Millisecond
+	defaultBindMaxBackoff = 10 * time.Second
+)
+
+// BindRetry configures retrying to listen while the address is still in use,
+// e.g. by the previous process on a quick restart.
+type BindRetry struct {
+	Attempts   int
+	Backoff    Duration
+	MaxBackoff Duration `toml:"max_backoff"`
+}
+
+// listenWithRetry opens the listener, retrying with exponential backoff as
+// long as the address is in use.
+func (p *OutPrometheus) listenWithRetry(l *Listener) (net.Listener, error) {
+	r := p.conf.BindRetry
+	backoff, max := r.Backoff.Duration, r.MaxBackoff.Duration
+	if backoff == 0 {
+		backoff = defaultBindBackoff
+	}
+	if max == 0 {
+		max = defaultBindMaxBackoff
+	}
+	for attempt := 1; ; attempt++ {
+		ln, err := l.listen()
+		if err == nil || attempt >= r.Attempts || !isAddrInUse(err) {
+			return ln, err
+		}
+		p.env.Log.Warningf("Failed to listen on %s (attempt %d/%d), retrying in %v: %v", l.Address, attempt, r.Attempts, backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > max {
+			backoff = max
+		}
+	}
+}
+
+func isAddrInUse(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE)
+}
+
+// Listener is an address to serve on, with its own TLS and authentication
+// settings.
+type Listener struct {
+	Address     string
+	SocketMode  string
+	TLSCert     string
+	TLSKey      string
+	TLSClientCA string
+	Username    string
+	Password    string
+	AuthToken   string
+
+	socketActivation bool
+}
+
+// ListenConfig is either a single address, for which the plugin-wide TLS and
+// authentication settings apply, or a list of listeners.
+type ListenConfig struct {
+	Address   string
+	Listeners []Listener
+}
+
+func (c *ListenConfig) UnmarshalTOML(v interface{}) error {
+	switch t := v.(type) {
+	case string:
+		c.Address = t
+		return nil
+	case []map[string]interface{}:
+		for _, x := range t {
+			if err := c.unmarshalListener(x); err != nil {
+				return err
+			}
+		}
+		return nil
+	case []interface{}:
+		for _, x := range t {
+			if err := c.unmarshalListener(x); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("listen must be a string or a list of tables: %v", v)
+}
+
+func (c *ListenConfig) unmarshalListener(v interface{}) error {
+	t, ok := v.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("Listener must be a table: %v", v)
+	}
+	var l Listener
+	for k, x := range t {
+		var err error
+		switch k {
+		case "address":
+			err = tomlString(k, x, &l.Address)
+		case "socket_mode":
+			err = tomlString(k, x, &l.SocketMode)
+		case "tls_cert":
+			err = tomlString(k, x, &l.TLSCert)
+		case "tls_key":
+			err = tomlString(k, x, &l.TLSKey)
+		case "tls_client_ca":
+			err = tomlString(k, x, &l.TLSClientCA)
+		case "username":
+			err = tomlString(k, x, &l.Username)
+		case "password":
+			err = tomlString(k, x, &l.Password)
+		case "auth_token":
+			err = tomlString(k, x, &l.AuthToken)
+		default:
+			err = fmt.Errorf("Unknown key of listener: %s", k)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if l.Address == "" {
+		return fmt.Errorf("address of listener is required")
+	}
+	c.Listeners = append(c.Listeners, l)
+	return nil
+}
+
+func (c *ListenConfig) empty() bool {
+	return c.Address == "" && len(c.Listeners) == 0
+}
+
+// listeners returns the listeners to serve on.
+func (c *Config) listeners() []Listener {
+	if len(c.Listen.Listeners) > 0 {
+		return c.Listen.Listeners
+	}
+	return []Listener{{
+		Address:     c.Listen.Address,
+		SocketMode:  c.SocketMode,
+		TLSCert:     c.TLSCert,
+		TLSKey:      c.TLSKey,
+		TLSClientCA: c.TLSClientCA,
+		Username:    c.Username,
+		Password:    c.Password,
+		AuthToken:   c.AuthToken,
+
+		socketActivation: c.SocketActivation,
+	}}
+}
+
+// listen opens the listener on l.Address, which is either a host:port for
+// TCP, a unix:// URL for a Unix domain socket or systemd:[name] for a socket
+// passed by systemd socket activation. With socket_activation, the first
+// socket passed is adopted if any.
+func (l *Listener) listen() (net.Listener, error) {
+	if strings.HasPrefix(l.Address, "systemd:") {
+		return inheritedListener(l.Address[len("systemd:"):])
+	}
+	if l.socketActivation && activated() {
+		return inheritedListener("")
+	}
+	if !strings.HasPrefix(l.Address, "unix://") {
+		return net.Listen("tcp", l.Address)
+	}
+	path := l.Address[len("unix://"):]
+	var mode os.FileMode
+	if l.SocketMode != "" {
+		n, err := strconv.ParseUint(l.SocketMode, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid socket_mode: %s", l.SocketMode)
+		}
+		mode = os.FileMode(n)
+	}
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err = os.Remove(path); err != nil {
+			return nil, fmt.Errorf("Failed to remove stale socket: %v", err)
+		}
+	}
+	// The socket file is removed when the listener is closed.
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if mode != 0 {
+		if err = os.Chmod(path, mode); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+// tlsConfig builds the TLS configuration of the listener. nil is returned if
+// TLS is not configured.
+func (l *Listener) tlsConfig() (*tls.Config, error) {
+	if l.TLSCert == "" && l.TLSKey == "" {
+		if l.TLSClientCA != "" {
+			return nil, errors.New("tls_client_ca requires tls_cert and tls_key")
+		}
+		return nil, nil
+	}
+	if l.TLSCert == "" || l.TLSKey == "" {
+		return nil, errors.New("Both tls_cert and tls_key must be set to enable TLS")
+	}
+	cert, err := tls.LoadX509KeyPair(l.TLSCert, l.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load TLS key pair: %v", err)
+	}
+	conf := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if l.TLSClientCA != "" {
+		b, err := ioutil.ReadFile(l.TLSClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read tls_client_ca: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("No certificate found in %s", l.TLSClientCA)
+		}
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return conf, nil
+}
+
+// hasAuth reports whether the listener requires credentials.
+func (l *Listener) hasAuth() bool {
+	return l.Username != "" || l.Password != "" || l.AuthToken != ""
+}
+
+// withAuth wraps h so that requests must carry the configured basic auth
+// credentials or bearer token. h is returned as is if neither is configured.
+func (l *Listener) withAuth(h http.Handler) http.Handler {
+	basic := l.Username != "" || l.Password != ""
+	if !l.hasAuth() {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if basic {
+			if user, pass, ok := r.BasicAuth(); ok && secureCompare(user, l.Username) && secureCompare(pass, l.Password) {
+				h.ServeHTTP(w, r)
+				return
+			}
+		}
+		if l.AuthToken != "" {
+			auth := r.Header.Get("Authorization")
+			if strings.HasPrefix(auth, "Bearer ") && secureCompare(auth[len("Bearer "):], l.AuthToken) {
+				h.ServeHTTP(w, r)
+				return
+			}
+		}
+		if basic {
+			w.Header().Add("WWW-Authenticate", `Basic realm="out-prometheus"`)
+		}
+		if l.AuthToken != "" {
+			w.Header().Add("WWW-Authenticate", `Bearer realm="out-prometheus"`)
+		}
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	})
+}
+
+// withAllowlist wraps h so that only clients in allow_cidrs are served. h is
+// returned as is if allow_cidrs is empty.
+func (p *OutPrometheus) withAllowlist(h http.Handler) (http.Handler, error) {
+	if len(p.conf.AllowCIDRs) == 0 {
+		return h, nil
+	}
+	nets, err := parseCIDRs(p.conf.AllowCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ip := p.conf.clientIP(r); ip != nil {
+			for _, n := range nets {
+				if n.Contains(ip) {
+					h.ServeHTTP(w, r)
+					return
+				}
+			}
+		}
+		p.stats.requestsDenied.Inc()
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	}), nil
+}
+
+// parseCIDRs parses allow_cidrs. A bare address is taken as a single host.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, s := range cidrs {
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid allow_cidrs: %s", cidrs[i])
+		}
+		nets[i] = n
+	}
+	return nets, nil
+}
+
+// clientIP returns the address of the client, or nil if unknown. With
+// trust_proxy_header, the last address in X-Forwarded-For, which is the one
+// appended by the proxy, takes precedence.
+func (c *Config) clientIP(r *http.Request) net.IP {
+	if c.TrustProxyHeader {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			addrs := strings.Split(xff, ",")
+			return net.ParseIP(strings.TrimSpace(addrs[len(addrs)-1]))
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+func secureCompare(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
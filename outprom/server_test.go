@@ -0,0 +1,190 @@
+package outprom
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/yosisa/fluxion/message"
+)
+
+func TestMetricsHandlerFiltersByName(t *testing.T) {
+	p := &OutPrometheus{registry: prometheus.NewRegistry()}
+	for _, name := range []string{"a_total", "b_total", "c_total"} {
+		p.registry.MustRegister(prometheus.NewCounter(prometheus.CounterOpts{Name: name, Help: name}))
+	}
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"a_total", "b_total", "c_total"}},
+		{"?name[]=b_total", []string{"b_total"}},
+		{"?name[]=a_total&name[]=c_total", []string{"a_total", "c_total"}},
+		{"?name[]=b_total&name[]=unknown", []string{"b_total"}},
+		{"?name[]=unknown", nil},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		p.metricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics"+tt.query, nil))
+		body, _ := ioutil.ReadAll(w.Body)
+		for _, name := range []string{"a_total", "b_total", "c_total"} {
+			if got, want := strings.Contains(string(body), "\n"+name+" 0\n"), contains(tt.want, name); got != want {
+				t.Errorf("%q: %s exposed = %v, want %v", tt.query, name, got, want)
+			}
+		}
+	}
+}
+
+func TestIsAddrInUse(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, err = net.Listen("tcp", ln.Addr().String())
+	if err == nil {
+		t.Fatal("listening twice on the same address succeeded")
+	}
+	if !isAddrInUse(err) {
+		t.Errorf("isAddrInUse(%v) = false", err)
+	}
+	if !isAddrInUse(fmt.Errorf("listener: %w", err)) {
+		t.Error("isAddrInUse of a wrapped error = false")
+	}
+	if isAddrInUse(errors.New("other")) {
+		t.Error("isAddrInUse of an unrelated error = true")
+	}
+}
+
+// TestServePortFile starts the plugin on port 0 and scrapes it at the port
+// written to port_file.
+func TestServePortFile(t *testing.T) {
+	portFile := filepath.Join(t.TempDir(), "port")
+	p := startPlugin(t, fmt.Sprintf(`
+listen = "127.0.0.1:0"
+port_file = %q
+
+[metrics.hits]
+type = "counter"
+`, portFile))
+	b, err := ioutil.ReadFile(portFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := strings.TrimSpace(string(b))
+	addrs := p.Addrs()
+	if len(addrs) != 1 || fmt.Sprint(addrs[0].(*net.TCPAddr).Port) != port {
+		t.Fatalf("Addrs() = %v, port_file has %q", addrs, port)
+	}
+	if _, err := p.Encode(&message.Event{Tag: "t", Record: map[string]interface{}{}}); err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.Get("http://127.0.0.1:" + port + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || !strings.Contains(string(body), "\nhits 1\n") {
+		t.Errorf("GET /metrics: %s\n%s", res.Status, body)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(portFile); !os.IsNotExist(err) {
+		t.Errorf("port_file is left after Close: %v", err)
+	}
+}
+
+func TestScrapeTimeout(t *testing.T) {
+	tests := []struct {
+		header string
+		max    time.Duration
+		want   time.Duration
+	}{
+		{"", 0, 0},
+		{"", time.Second, time.Second},
+		{"10", 0, 9 * time.Second},
+		{"10", time.Second, time.Second},
+		{"0.5", time.Second, 450 * time.Millisecond},
+		{"invalid", time.Second, time.Second},
+		{"-1", 0, 0},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		if tt.header != "" {
+			r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", tt.header)
+		}
+		if got := scrapeTimeout(r, tt.max); got != tt.want {
+			t.Errorf("scrapeTimeout(%q, %v) = %v, want %v", tt.header, tt.max, got, tt.want)
+		}
+	}
+}
+
+// slowCollector blocks Collect until release is closed.
+type slowCollector struct{ release chan struct{} }
+
+func (c slowCollector) Describe(chan<- *prometheus.Desc) {}
+
+func (c slowCollector) Collect(chan<- prometheus.Metric) { <-c.release }
+
+func TestMetricsHandlerHonorsScrapeTimeoutHeader(t *testing.T) {
+	c := slowCollector{make(chan struct{})}
+	defer close(c.release)
+	p := &OutPrometheus{registry: prometheus.NewRegistry()}
+	p.conf.ScrapeTimeout.Duration = time.Minute
+	p.registry.MustRegister(c)
+	r := httptest.NewRequest("GET", "/metrics", nil)
+	r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "0.05")
+	w := httptest.NewRecorder()
+	start := time.Now()
+	p.metricsHandler().ServeHTTP(w, r)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("scrape took %v despite the header", d)
+	}
+}
+
+func TestOpenMetricsUnit(t *testing.T) {
+	p := &OutPrometheus{registry: prometheus.NewRegistry()}
+	p.conf.OpenMetrics = true
+	for name, src := range map[string]string{
+		"latency":  "type = \"gauge\"\nunit = \"seconds\"\n",
+		"sent":     "type = \"counter\"\nunit = \"bytes\"\n",
+		"duration": "type = \"histogram\"\nunit = \"seconds\"\n",
+		"rate":     "type = \"rate\"\nunit = \"bytes\"\nwindow = \"1m\"\n",
+	} {
+		m := decodeMetric(t, src+"value = \"v\"\n")
+		h, err := m.New(name, p.registry, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		handle(t, h, newEvent("t", map[string]interface{}{"v": 1.0}))
+	}
+	r := httptest.NewRequest("GET", "/metrics", nil)
+	r.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+	w := httptest.NewRecorder()
+	p.metricsHandler().ServeHTTP(w, r)
+	body := w.Body.String()
+	for _, want := range []string{
+		"# UNIT latency_seconds seconds\n",
+		"# UNIT sent_bytes bytes\n",
+		"# UNIT duration_seconds seconds\n",
+		"# UNIT rate_bytes bytes\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %q in:\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package outprom
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const defaultStateInterval = time.Minute
+
+// counterState is the snapshot of a counter saved to state_file under its
+// fully qualified name, as definitions sharing the name share the counter.
+// The label keys are kept so that values are not restored into a metric whose
+// labels changed.
+type counterState struct {
+	Labels []string      `json:"labels"`
+	Series []seriesState `json:"series"`
+}
+
+type seriesState struct {
+	Values []string `json:"values"`
+	Value  float64  `json:"value"`
+}
+
+// startState starts saving the counters to state_file periodically. A final
+// snapshot is saved when the plugin is stopped.
+func (p *OutPrometheus) startState() {
+	interval := p.conf.StateInterval.Duration
+	if interval == 0 {
+		interval = defaultStateInterval
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.saveState()
+			case <-p.stop:
+				p.saveState()
+				return
+			}
+		}
+	}()
+}
+
+func (p *OutPrometheus) saveState() {
+	state := make(map[string]counterState)
+	for _, h := range p.loadHandlers() {
+		if c, ok := h.(*Counter); ok {
+			fq := c.fqName(c.name)
+			if _, ok := state[fq]; !ok {
+				state[fq] = c.snapshot()
+			}
+		}
+	}
+	b, err := json.Marshal(state)
+	if err == nil {
+		err = writeFileAtomic(p.conf.StateFile, b)
+	}
+	if err != nil {
+		p.env.Log.Errorf("Failed to save state: %v", err)
+	}
+}
+
+// restoreState adds the counter values saved in state_file to the counters.
+// A missing file is not an error.
+func (p *OutPrometheus) restoreState(handlers []Handler) error {
+	b, err := ioutil.ReadFile(p.conf.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var state map[string]counterState
+	if err = json.Unmarshal(b, &state); err != nil {
+		return err
+	}
+	restored := make(map[*prometheus.CounterVec]bool)
+	for _, h := range handlers {
+		c, ok := h.(*Counter)
+		if !ok || restored[c.CounterVec] {
+			continue
+		}
+		s, ok := state[c.fqName(c.name)]
+		if !ok {
+			continue
+		}
+		restored[c.CounterVec] = true
+		if !equalStrings(s.Labels, c.labelKeys) {
+			p.env.Log.Warningf("Skipped restoring metrics.%s: labels changed from %v to %v", c.name, s.Labels, c.labelKeys)
+			continue
+		}
+		c.restore(s.Series)
+	}
+	return nil
+}
+
+func (c *Counter) snapshot() counterState {
+	s := counterState{Labels: c.labelKeys}
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.CounterVec.Collect(ch)
+		close(ch)
+	}()
+	for m := range ch {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil || pb.Counter == nil {
+			continue
+		}
+		labels := make(map[string]string, len(pb.Label))
+		for _, lp := range pb.Label {
+			labels[lp.GetName()] = lp.GetValue()
+		}
+		values := make([]string, len(c.labelKeys))
+		for i, key := range c.labelKeys {
+			values[i] = labels[key]
+		}
+		s.Series = append(s.Series, seriesState{values, pb.Counter.GetValue()})
+	}
+	return s
+}
+
+func (c *Counter) restore(series []seriesState) {
+	for _, s := range series {
+		if len(s.Values) != len(c.labelKeys) || s.Value < 0 {
+			continue
+		}
+		lvals := s.Values
+		if c.topk != nil {
+			c.topk.restore(lvals, s.Value)
+			continue
+		}
+		if c.limiter != nil {
+			var ok bool
+			if lvals, ok = c.limiter.admit(lvals); !ok {
+				continue
+			}
+		}
+		c.child(lvals).Add(s.Value)
+		if c.expirer != nil {
+			c.expirer.touch(lvals)
+		}
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// writeFileAtomic writes b to a temporary file and renames it to path, so
+// readers never see a partially written file.
+func writeFileAtomic(path string, b []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,47 @@
+package outprom
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func newStatePlugin(t *testing.T, file string, metrics map[string]Metric) (*OutPrometheus, *prometheus.Registry) {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	p := &OutPrometheus{stats: newStats(), conf: Config{StateFile: file}}
+	handlers, err := p.buildHandlers(metrics, newCollectorSet(reg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.restoreState(handlers); err != nil {
+		t.Fatal(err)
+	}
+	p.handlers.Store(newHandlerSet(handlers, metrics))
+	return p, reg
+}
+
+func TestStateSharedCounter(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "state.json")
+	def := decodeMetric(t, `
+type = "counter"
+value = "count"
+`)
+	ns := def
+	ns.Namespace = "app"
+	metrics := map[string]Metric{"app_hits": def, "hits": ns}
+
+	p, reg := newStatePlugin(t, file, metrics)
+	for _, h := range p.loadHandlers() {
+		handle(t, h, newEvent("t", map[string]interface{}{"count": 2.0}))
+	}
+	assertMetrics(t, reg, `app_hits 4`)
+	p.saveState()
+
+	for i := 0; i < 2; i++ {
+		p, reg = newStatePlugin(t, file, metrics)
+		assertMetrics(t, reg, `app_hits 4`)
+		p.saveState()
+	}
+}
@@ -0,0 +1,146 @@
+package outprom
+
+import (
+	"runtime"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const statsNamespace = "fluxion_out_prometheus"
+
+// stats holds the metrics about the plugin itself, which are exposed on the
+// same registry as the configured metrics, and the path index shared by its
+// handlers.
+type stats struct {
+	paths             *pathIndex
+	eventsReceived    prometheus.Counter
+	handlerErrors     *prometheus.CounterVec
+	configuredMetrics prometheus.Gauge
+	lastEvent         prometheus.Gauge
+	seriesLimited     *prometheus.CounterVec
+	samplesDropped    *prometheus.CounterVec
+	buildInfo         prometheus.Gauge
+	requestsDenied    prometheus.Counter
+	queueDropped      *prometheus.CounterVec
+	metricLastEvent   *prometheus.GaugeVec
+	metricEvents      *prometheus.CounterVec
+}
+
+func newStats() *stats {
+	s := &stats{
+		paths: newPathIndex(),
+		eventsReceived: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: statsNamespace,
+			Name:      "events_received_total",
+			Help:      "Number of events received by the plugin.",
+		}),
+		handlerErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: statsNamespace,
+			Name:      "handler_errors_total",
+			Help:      "Number of errors occurred while handling events.",
+		}, []string{"metric", "kind"}),
+		configuredMetrics: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: statsNamespace,
+			Name:      "configured_metrics",
+			Help:      "Number of configured metrics.",
+		}),
+		lastEvent: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: statsNamespace,
+			Name:      "last_event_timestamp_seconds",
+			Help:      "Unix timestamp of the last successfully processed event.",
+		}),
+		seriesLimited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: statsNamespace,
+			Name:      "series_limited_samples_total",
+			Help:      "Number of samples dropped or folded into the overflow series by max_series.",
+		}, []string{"metric", "action"}),
+		samplesDropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: statsNamespace,
+			Name:      "samples_dropped_total",
+			Help:      "Number of samples dropped because of their values.",
+		}, []string{"metric", "reason"}),
+		requestsDenied: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: statsNamespace,
+			Name:      "http_requests_denied_total",
+			Help:      "Number of HTTP requests rejected by allow_cidrs.",
+		}),
+		queueDropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: statsNamespace,
+			Name:      "queue_dropped_total",
+			Help:      "Number of events dropped because the queue of the worker was full.",
+		}, []string{"metric"}),
+		metricLastEvent: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "fluxion_metric_last_event_timestamp_seconds",
+			Help: "Unix timestamp of the last event consumed by each configured metric.",
+		}, []string{"metric"}),
+		metricEvents: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "fluxion_metric_events_total",
+			Help: "Number of events consumed by each configured metric.",
+		}, []string{"metric"}),
+		buildInfo: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: statsNamespace,
+			Name:      "build_info",
+			Help:      "Build information of the plugin, fixed at 1.",
+			ConstLabels: prometheus.Labels{
+				"version":    Version,
+				"revision":   Revision,
+				"go_version": runtime.Version(),
+			},
+		}),
+	}
+	s.buildInfo.Set(1)
+	return s
+}
+
+func (s *stats) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		s.eventsReceived,
+		s.handlerErrors,
+		s.configuredMetrics,
+		s.lastEvent,
+		s.seriesLimited,
+		s.samplesDropped,
+		s.buildInfo,
+		s.requestsDenied,
+		s.queueDropped,
+		s.metricLastEvent,
+		s.metricEvents,
+	}
+}
+
+// metricStats are the series of a configured metric in the per-metric
+// statistics, resolved once so that consuming an event needs no lookup.
+type metricStats struct {
+	events    prometheus.Counter
+	lastEvent prometheus.Gauge
+}
+
+// metric returns the series of the metric of the given config key.
+func (s *stats) metric(name string) metricStats {
+	return metricStats{
+		events:    s.metricEvents.WithLabelValues(name),
+		lastEvent: s.metricLastEvent.WithLabelValues(name),
+	}
+}
+
+// consumed records that the metric consumed an event at now.
+func (ms metricStats) consumed(now time.Time) {
+	ms.events.Inc()
+	ms.lastEvent.Set(float64(now.UnixNano()) / 1e9)
+}
+
+// forget deletes the per-metric series of a metric removed from the config.
+func (s *stats) forget(name string) {
+	s.metricEvents.DeleteLabelValues(name)
+	s.metricLastEvent.DeleteLabelValues(name)
+}
+
+func (s *stats) register(reg prometheus.Registerer) error {
+	for _, c := range s.collectors() {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package outprom
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+)
+
+// compileTagPattern compiles a tag pattern into a regexp. A pattern enclosed
+// in slashes is treated as a regular expression as is. Otherwise it is a glob
+// evaluated per dot-separated part: "*" matches within a single part and a
+// part consisting of "**" matches zero or more parts.
+func compileTagPattern(p string) (*regexp.Regexp, error) {
+	if len(p) > 1 && strings.HasPrefix(p, "/") && strings.HasSuffix(p, "/") {
+		return regexp.Compile(p[1 : len(p)-1])
+	}
+	parts := strings.Split(p, ".")
+	var buf bytes.Buffer
+	buf.WriteString("^")
+	for i, part := range parts {
+		if part == "**" {
+			switch {
+			case len(parts) == 1:
+				buf.WriteString(".*")
+			case i == 0:
+				buf.WriteString(`(?:.*\.)?`)
+			default:
+				buf.WriteString(`(?:\..*)?`)
+			}
+			continue
+		}
+		if i > 0 && !(i == 1 && parts[0] == "**") {
+			buf.WriteString(`\.`)
+		}
+		for j, s := range strings.Split(part, "*") {
+			if j > 0 {
+				buf.WriteString(`[^.]*`)
+			}
+			buf.WriteString(regexp.QuoteMeta(s))
+		}
+	}
+	buf.WriteString("$")
+	return regexp.Compile(buf.String())
+}
+
+// tagPart returns the nth dot-separated part of tag, or the whole tag if n is
+// negative. An empty string is returned if the tag has fewer parts.
+func tagPart(tag string, n int) string {
+	if n < 0 {
+		return tag
+	}
+	parts := strings.Split(tag, ".")
+	if n >= len(parts) {
+		return ""
+	}
+	return parts[n]
+}
@@ -0,0 +1,77 @@
+package outprom
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultTagCounterMaxTags  = 1000
+	defaultTagCounterOtherTag = "other"
+)
+
+// tagCounter counts the events per tag regardless of the configured metrics.
+// The tag is truncated to tag_counter_depth components, and once
+// tag_counter_max_tags distinct tags are seen the others are counted as
+// tag_counter_other_tag, "other" by default. That series only exists once a
+// tag overflowed, and a real tag of the same name is counted into it.
+type tagCounter struct {
+	vec      *prometheus.CounterVec
+	depth    int
+	max      int64
+	count    int64
+	tags     sync.Map // tag -> prometheus.Counter
+	otherTag string
+	once     sync.Once
+	other    prometheus.Counter
+}
+
+func newTagCounter(depth, max int, otherTag string) *tagCounter {
+	if max <= 0 {
+		max = defaultTagCounterMaxTags
+	}
+	if otherTag == "" {
+		otherTag = defaultTagCounterOtherTag
+	}
+	vec := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "fluxion_events_total",
+		Help: "Number of events received per tag.",
+	}, []string{"tag"})
+	return &tagCounter{vec: vec, depth: depth, max: int64(max), otherTag: otherTag}
+}
+
+// overflowed counts an event whose tag is not tracked.
+func (t *tagCounter) overflowed() {
+	t.once.Do(func() { t.other = t.vec.WithLabelValues(t.otherTag) })
+	t.other.Inc()
+}
+
+func (t *tagCounter) inc(tag string) {
+	if t.depth > 0 {
+		if parts := strings.SplitN(tag, ".", t.depth+1); len(parts) > t.depth {
+			tag = strings.Join(parts[:t.depth], ".")
+		}
+	}
+	if c, ok := t.tags.Load(tag); ok {
+		c.(prometheus.Counter).Inc()
+		return
+	}
+	// The other tag is reserved, so that it does not take a slot of its own.
+	if tag == t.otherTag {
+		t.overflowed()
+		return
+	}
+	if atomic.AddInt64(&t.count, 1) > t.max {
+		atomic.AddInt64(&t.count, -1)
+		t.overflowed()
+		return
+	}
+	c, loaded := t.tags.LoadOrStore(tag, t.vec.WithLabelValues(tag))
+	if loaded {
+		atomic.AddInt64(&t.count, -1)
+	}
+	c.(prometheus.Counter).Inc()
+}
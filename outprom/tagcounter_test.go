@@ -0,0 +1,42 @@
+package outprom
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestTagCounter(t *testing.T) {
+	tc := newTagCounter(2, 2, "")
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(tc.vec)
+	for _, tag := range []string{"app.web.access", "app.web.error"} {
+		tc.inc(tag)
+	}
+	// The other series is not created before a tag overflowed.
+	assertMetrics(t, reg, `
+fluxion_events_total{tag="app.web"} 2
+`)
+	// A real tag named other does not take a slot of its own.
+	for _, tag := range []string{"other", "db.query", "cache"} {
+		tc.inc(tag)
+	}
+	assertMetrics(t, reg, `
+fluxion_events_total{tag="app.web"} 2
+fluxion_events_total{tag="db.query"} 1
+fluxion_events_total{tag="other"} 2
+`)
+}
+
+func TestTagCounterOtherTag(t *testing.T) {
+	tc := newTagCounter(0, 1, "overflow")
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(tc.vec)
+	for _, tag := range []string{"overflow", "a", "b"} {
+		tc.inc(tag)
+	}
+	assertMetrics(t, reg, `
+fluxion_events_total{tag="a"} 1
+fluxion_events_total{tag="overflow"} 2
+`)
+}
@@ -0,0 +1,183 @@
+package outprom
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const defaultMaxGenerated = 100
+
+var (
+	namePlaceholderRe = regexp.MustCompile(`%tag(?:\[(\d+)\])?%`)
+	invalidNameCharRe = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+)
+
+// templatedMetric is a handler for a metric having name_template. A metric is
+// created lazily for each name generated from the event tag, up to
+// max_generated. With ttl, a generated metric not updated within ttl is
+// dropped as a whole.
+type templatedMetric struct {
+	Metric
+	raw      Metric
+	st       *stats
+	max      int
+	limited  prometheus.Counter
+	mu       sync.RWMutex
+	children map[string]Handler
+	ctx      context.Context
+}
+
+func newTemplatedMetric(name string, m *Metric, raw Metric, st *stats) (*templatedMetric, error) {
+	raw.NameTemplate = ""
+	raw.TTL = Duration{}
+	// New fills in the metric it is called on, so validate a copy and keep
+	// raw intact for the children.
+	check := raw
+	if _, err := check.New(name, prometheus.NewRegistry(), st); err != nil {
+		return nil, err
+	}
+	t := &templatedMetric{
+		Metric:   *m,
+		raw:      raw,
+		st:       st,
+		max:      m.MaxGenerated,
+		limited:  st.seriesLimited.WithLabelValues(name, "drop"),
+		children: make(map[string]Handler),
+		ctx:      context.Background(),
+	}
+	if t.max == 0 {
+		t.max = defaultMaxGenerated
+	}
+	t.raw.watch = m.watch
+	t.expirer = nil
+	if m.TTL.Duration > 0 {
+		t.expirer = newSeriesExpirer(m.TTL.Duration)
+		t.expirer.vec = t
+	}
+	return t, nil
+}
+
+// generateName substitutes the tag parts for the placeholders of the
+// template. Characters not allowed in a metric name become underscores.
+func generateName(tmpl, tag string) string {
+	name := namePlaceholderRe.ReplaceAllStringFunc(tmpl, func(s string) string {
+		n := -1
+		if sm := namePlaceholderRe.FindStringSubmatch(s); sm[1] != "" {
+			n, _ = strconv.Atoi(sm[1])
+		}
+		return tagPart(tag, n)
+	})
+	return invalidNameCharRe.ReplaceAllString(name, "_")
+}
+
+func (t *templatedMetric) child(tag string, create bool) (Handler, error) {
+	name := generateName(t.NameTemplate, tag)
+	t.mu.RLock()
+	h, ok := t.children[name]
+	t.mu.RUnlock()
+	if ok || !create {
+		return h, nil
+	}
+	if err := validateMetricName(name); err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if h, ok = t.children[name]; ok {
+		return h, nil
+	}
+	if len(t.children) >= t.max {
+		t.limited.Inc()
+		return nil, errSkip
+	}
+	m := t.raw
+	h, err := m.New(name, prometheus.NewRegistry(), t.st)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.Start(t.ctx); err != nil {
+		return nil, err
+	}
+	t.children[name] = h
+	return h, nil
+}
+
+// Start records ctx for the children generated later.
+func (t *templatedMetric) Start(ctx context.Context) error {
+	t.Metric.Start(ctx)
+	t.mu.Lock()
+	t.ctx = ctx
+	t.mu.Unlock()
+	return nil
+}
+
+// Close closes the generated metrics.
+func (t *templatedMetric) Close() error {
+	t.mu.Lock()
+	children := t.children
+	t.children = make(map[string]Handler)
+	t.mu.Unlock()
+	var first error
+	for _, h := range children {
+		if err := h.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (t *templatedMetric) HandleEvent(ev *event) error {
+	h, err := t.child(ev.Tag, true)
+	if err != nil {
+		return err
+	}
+	if t.expirer != nil {
+		t.expirer.touch([]string{generateName(t.NameTemplate, ev.Tag)})
+	}
+	return h.HandleEvent(ev)
+}
+
+func (t *templatedMetric) tombstone(ev *event) (bool, error) {
+	if len(t.DeleteWhen) == 0 || !t.matchFilters(ev, t.DeleteWhen, t.DeleteWhenMode == "any") {
+		return false, nil
+	}
+	h, err := t.child(ev.Tag, false)
+	if err != nil || h == nil {
+		return true, err
+	}
+	return h.tombstone(ev)
+}
+
+// DeleteLabelValues drops the generated metric of the given name.
+func (t *templatedMetric) DeleteLabelValues(lvals ...string) bool {
+	name := strings.Join(lvals, "")
+	t.mu.Lock()
+	h, ok := t.children[name]
+	delete(t.children, name)
+	t.mu.Unlock()
+	if ok {
+		h.Close()
+	}
+	return ok
+}
+
+// Describe sends no descriptors, making the metric an unchecked collector as
+// the generated names are not known in advance.
+func (t *templatedMetric) Describe(ch chan<- *prometheus.Desc) {}
+
+func (t *templatedMetric) Collect(ch chan<- prometheus.Metric) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, h := range t.children {
+		h.Collect(ch)
+	}
+}
+
+func (t *templatedMetric) expiry() *seriesExpirer {
+	return t.expirer
+}
@@ -0,0 +1,62 @@
+package outprom
+
+import (
+	"context"
+	"testing"
+)
+
+func TestTemplatedMetricWithLabels(t *testing.T) {
+	h, reg := newTestHandler(t, `
+type = "counter"
+name_template = "requests_%tag[1]%"
+value = "count"
+labels = { host = "host" }
+`)
+	handle(t, h, newEvent("app.web", map[string]interface{}{"count": 1.0, "host": "a"}))
+	handle(t, h, newEvent("app.web", map[string]interface{}{"count": 2.0, "host": "a"}))
+	handle(t, h, newEvent("app.api", map[string]interface{}{"count": 4.0, "host": "b"}))
+	assertMetrics(t, reg, `
+requests_api{host="b"} 4
+requests_web{host="a"} 3
+`)
+}
+
+type closeCounter struct {
+	Handler
+	closed int
+}
+
+func (c *closeCounter) Close() error {
+	c.closed++
+	return nil
+}
+
+func TestTemplatedMetricClosesChildren(t *testing.T) {
+	h, _ := newTestHandler(t, `
+type = "gauge"
+name_template = "size_%tag[1]%"
+value = "size"
+`)
+	tm := h.(*templatedMetric)
+	if err := tm.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	handle(t, h, newEvent("app.web", map[string]interface{}{"size": 1.0}))
+	handle(t, h, newEvent("app.api", map[string]interface{}{"size": 1.0}))
+	web := &closeCounter{Handler: tm.children["size_web"]}
+	api := &closeCounter{Handler: tm.children["size_api"]}
+	tm.children["size_web"], tm.children["size_api"] = web, api
+
+	if !tm.DeleteLabelValues("size_web") {
+		t.Fatal("DeleteLabelValues did not find size_web")
+	}
+	if web.closed != 1 {
+		t.Errorf("deleted child closed %d times, want 1", web.closed)
+	}
+	if err := tm.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if api.closed != 1 || web.closed != 1 {
+		t.Errorf("children closed %d and %d times, want 1 each", api.closed, web.closed)
+	}
+}
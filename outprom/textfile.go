@@ -0,0 +1,42 @@
+package outprom
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const defaultTextfileInterval = 15 * time.Second
+
+// startTextfile starts writing the registry to textfile_path periodically in
+// the text exposition format, for node_exporter's textfile collector. A final
+// snapshot is written when the plugin is stopped.
+func (p *OutPrometheus) startTextfile() {
+	interval := p.conf.TextfileInterval.Duration
+	if interval == 0 {
+		interval = defaultTextfileInterval
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.writeTextfile()
+			case <-p.stop:
+				p.writeTextfile()
+				return
+			}
+		}
+	}()
+}
+
+func (p *OutPrometheus) writeTextfile() {
+	// WriteToTextfile writes to a temporary file and renames it, so the
+	// collector never reads a partially written file.
+	if err := prometheus.WriteToTextfile(p.conf.TextfilePath, p.registry); err != nil {
+		p.env.Log.Errorf("Failed to write textfile: %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package outprom
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	defaultLogThrottleInterval = 10 * time.Second
+	logThrottleMaxKeys         = 1000
+)
+
+// logThrottle limits how often the errors of the same metric and kind are
+// logged. The first occurrence is logged immediately, then at most one per
+// interval which reports how many were suppressed since the last one.
+type logThrottle struct {
+	interval time.Duration
+	mu       sync.Mutex
+	entries  map[string]*throttleEntry
+}
+
+type throttleEntry struct {
+	since      time.Time
+	suppressed int
+}
+
+func newLogThrottle(interval time.Duration) *logThrottle {
+	if interval == 0 {
+		interval = defaultLogThrottleInterval
+	}
+	return &logThrottle{interval: interval, entries: make(map[string]*throttleEntry)}
+}
+
+// allow reports whether an error of the key should be logged now, and if so
+// how many were suppressed before it.
+func (t *logThrottle) allow(key string) (int, bool) {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.entries[key]
+	if !ok {
+		if len(t.entries) >= logThrottleMaxKeys {
+			t.expire(now)
+		}
+		if len(t.entries) < logThrottleMaxKeys {
+			t.entries[key] = &throttleEntry{since: now}
+		}
+		return 0, true
+	}
+	if now.Sub(e.since) < t.interval {
+		e.suppressed++
+		return 0, false
+	}
+	n := e.suppressed
+	e.since, e.suppressed = now, 0
+	return n, true
+}
+
+// expire drops the entries whose interval has passed; the suppressed counts
+// they hold are only available from the error counter afterwards.
+func (t *logThrottle) expire(now time.Time) {
+	for key, e := range t.entries {
+		if now.Sub(e.since) >= t.interval {
+			delete(t.entries, key)
+		}
+	}
+}
+
+// logError logs the error of the handler through the throttle.
+func (p *OutPrometheus) logError(h Handler, err error) {
+	n, ok := p.logs.allow(h.metricName() + "\x00" + errorKind(err))
+	if !ok {
+		return
+	}
+	if n > 0 {
+		p.env.Log.Errorf("%v (repeated %d times)", err, n)
+		return
+	}
+	p.env.Log.Error(err)
+}
@@ -0,0 +1,207 @@
+package outprom
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	topkSketchFactor = 10
+	topkOtherValue   = "_other"
+)
+
+// topkVec exposes only the series of a counter vector with the K largest
+// counts. The counts are approximated by a space-saving sketch holding a
+// fixed number of label sets, so that memory does not grow with the distinct
+// values seen. The rest is summed up in the series whose label values are all
+// "_other". The exposed set is recomputed on every collection.
+type topkVec struct {
+	vec        *prometheus.CounterVec
+	k          int
+	otherLvals []string
+	mu         sync.Mutex
+	sketch     spaceSaving
+	total      float64
+	published  map[string]*publishedSeries
+	other      float64
+}
+
+type publishedSeries struct {
+	lvals []string
+	value float64
+}
+
+func newTopKVec(vec *prometheus.CounterVec, k, nlabels int) *topkVec {
+	other := make([]string, nlabels)
+	for i := range other {
+		other[i] = topkOtherValue
+	}
+	return &topkVec{
+		vec:        vec,
+		k:          k,
+		otherLvals: other,
+		sketch:     newSpaceSaving(k * topkSketchFactor),
+		published:  make(map[string]*publishedSeries),
+	}
+}
+
+func (t *topkVec) add(lvals []string, v float64) {
+	// Zero increments only make a series exist, which the top-K decides.
+	if v == 0 {
+		return
+	}
+	t.mu.Lock()
+	t.sketch.add(lvals, v)
+	t.total += v
+	t.mu.Unlock()
+}
+
+// restore adds a value saved from the exposed series. The remainder only adds
+// to the total so that it is not mistaken for a label set.
+func (t *topkVec) restore(lvals []string, v float64) {
+	t.mu.Lock()
+	if !equalStrings(lvals, t.otherLvals) {
+		t.sketch.add(lvals, v)
+	}
+	t.total += v
+	t.mu.Unlock()
+}
+
+func (t *topkVec) forget(lvals []string) {
+	key := seriesKey(lvals)
+	t.mu.Lock()
+	if e, ok := t.sketch.items[key]; ok {
+		t.total -= e.count
+		t.sketch.remove(e)
+	}
+	delete(t.published, key)
+	t.mu.Unlock()
+}
+
+// sync brings the series of the vector in line with the current top-K.
+// Counters only move forward, so a count which became smaller because of the
+// approximation is kept until it is exceeded again.
+func (t *topkVec) sync() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	top := t.sketch.top(t.k)
+	current := make(map[string]bool, len(top))
+	var sum float64
+	for _, e := range top {
+		current[e.key] = true
+		sum += e.count
+		p, ok := t.published[e.key]
+		if !ok {
+			p = &publishedSeries{lvals: e.lvals}
+			t.published[e.key] = p
+		}
+		if d := e.count - p.value; d > 0 {
+			t.vec.WithLabelValues(p.lvals...).Add(d)
+			p.value = e.count
+		}
+	}
+	for key, p := range t.published {
+		if !current[key] {
+			t.vec.DeleteLabelValues(p.lvals...)
+			delete(t.published, key)
+		}
+	}
+	if d := t.total - sum - t.other; d > 0 {
+		t.vec.WithLabelValues(t.otherLvals...).Add(d)
+		t.other += d
+	}
+}
+
+func (t *topkVec) Describe(ch chan<- *prometheus.Desc) {
+	t.vec.Describe(ch)
+}
+
+func (t *topkVec) Collect(ch chan<- prometheus.Metric) {
+	t.sync()
+	t.vec.Collect(ch)
+}
+
+// spaceSaving is the space-saving heavy hitters sketch. Once full, a new label
+// set replaces the one with the smallest count and inherits that count as its
+// overestimation.
+type spaceSaving struct {
+	size  int
+	items map[string]*ssEntry
+	heap  ssHeap
+}
+
+type ssEntry struct {
+	key   string
+	lvals []string
+	count float64
+	index int
+}
+
+func newSpaceSaving(size int) spaceSaving {
+	return spaceSaving{size: size, items: make(map[string]*ssEntry, size)}
+}
+
+func (s *spaceSaving) add(lvals []string, v float64) {
+	key := seriesKey(lvals)
+	if e, ok := s.items[key]; ok {
+		e.count += v
+		heap.Fix(&s.heap, e.index)
+		return
+	}
+	lvals = append([]string(nil), lvals...)
+	if len(s.heap) < s.size {
+		e := &ssEntry{key: key, lvals: lvals, count: v}
+		s.items[key] = e
+		heap.Push(&s.heap, e)
+		return
+	}
+	e := s.heap[0]
+	delete(s.items, e.key)
+	e.key, e.lvals = key, lvals
+	e.count += v
+	s.items[key] = e
+	heap.Fix(&s.heap, 0)
+}
+
+func (s *spaceSaving) remove(e *ssEntry) {
+	delete(s.items, e.key)
+	heap.Remove(&s.heap, e.index)
+}
+
+// top returns up to k entries with the largest counts.
+func (s *spaceSaving) top(k int) []*ssEntry {
+	entries := append([]*ssEntry(nil), s.heap...)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].count > entries[j].count })
+	if len(entries) > k {
+		entries = entries[:k]
+	}
+	return entries
+}
+
+// ssHeap is a min-heap of the entries by count.
+type ssHeap []*ssEntry
+
+func (h ssHeap) Len() int           { return len(h) }
+func (h ssHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+
+func (h ssHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *ssHeap) Push(x interface{}) {
+	e := x.(*ssEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *ssHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
@@ -0,0 +1,84 @@
+package outprom
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+const topkMetric = `
+type = "counter"
+value = "count"
+labels = { path = "path" }
+topk = 2
+`
+
+func TestTopK(t *testing.T) {
+	h, reg := newTestHandler(t, topkMetric)
+	for path, n := range map[string]float64{"/a": 10, "/b": 5, "/c": 1, "/d": 2} {
+		handle(t, h, newEvent("t", map[string]interface{}{"count": n, "path": path}))
+	}
+	assertMetrics(t, reg, `
+test{path="/a"} 10
+test{path="/b"} 5
+test{path="_other"} 3
+`)
+	// /c overtakes /b, which must disappear.
+	handle(t, h, newEvent("t", map[string]interface{}{"count": 20.0, "path": "/c"}))
+	assertMetrics(t, reg, `
+test{path="/a"} 10
+test{path="/c"} 21
+test{path="_other"} 7
+`)
+}
+
+func TestTopKBoundedBySketch(t *testing.T) {
+	h, _ := newTestHandler(t, topkMetric)
+	for i := 0; i < 1000; i++ {
+		handle(t, h, newEvent("t", map[string]interface{}{"count": 1.0, "path": fmt.Sprint(i)}))
+	}
+	if n := len(h.(*Counter).topk.sketch.items); n > 2*topkSketchFactor {
+		t.Errorf("sketch holds %d label sets, want at most %d", n, 2*topkSketchFactor)
+	}
+}
+
+func TestTopKIgnoresZeroIncrements(t *testing.T) {
+	h, _ := newTestHandler(t, `
+type = "counter"
+count_mode = "exist"
+value = "error"
+labels = { path = "path" }
+topk = 2
+`)
+	handle(t, h, newEvent("t", map[string]interface{}{"path": "/a"}))
+	if n := len(h.(*Counter).topk.sketch.items); n != 0 {
+		t.Errorf("sketch holds %d label sets after zero increments, want 0", n)
+	}
+}
+
+func TestTopKState(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "state.json")
+	metrics := map[string]Metric{"hits": decodeMetric(t, topkMetric)}
+	p, reg := newStatePlugin(t, file, metrics)
+	h := p.loadHandlers()[0]
+	for path, n := range map[string]float64{"/a": 10, "/b": 5, "/c": 1} {
+		handle(t, h, newEvent("t", map[string]interface{}{"count": n, "path": path}))
+	}
+	want := `
+hits{path="/a"} 10
+hits{path="/b"} 5
+hits{path="_other"} 1
+`
+	assertMetrics(t, reg, want)
+	p.saveState()
+
+	p, reg = newStatePlugin(t, file, metrics)
+	assertMetrics(t, reg, want)
+	// Restored series leave the top-K like any other.
+	handle(t, p.loadHandlers()[0], newEvent("t", map[string]interface{}{"count": 30.0, "path": "/d"}))
+	assertMetrics(t, reg, `
+hits{path="/a"} 10
+hits{path="/d"} 30
+hits{path="_other"} 6
+`)
+}
@@ -0,0 +1,101 @@
+package outprom
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// seriesExpirer keeps track of the last update time of each label set of a
+// metric and deletes the series which have not been updated within ttl. With
+// zero ttl it only deletes series on request.
+type seriesExpirer struct {
+	ttl    time.Duration
+	vec    Handler
+	forget []func(key string)
+	mu     sync.Mutex
+	series map[string]*seriesEntry
+}
+
+type seriesEntry struct {
+	values  []string
+	updated time.Time
+}
+
+func newSeriesExpirer(ttl time.Duration) *seriesExpirer {
+	return &seriesExpirer{ttl: ttl, series: make(map[string]*seriesEntry)}
+}
+
+// seriesKey returns a key identifying the label set.
+func seriesKey(lvals []string) string {
+	return strings.Join(lvals, "\xff")
+}
+
+func (e *seriesExpirer) touch(lvals []string) {
+	if e.ttl == 0 {
+		return
+	}
+	key := seriesKey(lvals)
+	now := time.Now()
+	e.mu.Lock()
+	if s, ok := e.series[key]; ok {
+		s.updated = now
+	} else {
+		e.series[key] = &seriesEntry{values: append([]string(nil), lvals...), updated: now}
+	}
+	e.mu.Unlock()
+}
+
+func (e *seriesExpirer) expire(now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for key, s := range e.series {
+		if now.Sub(s.updated) >= e.ttl {
+			e.vec.DeleteLabelValues(s.values...)
+			delete(e.series, key)
+			for _, forget := range e.forget {
+				forget(key)
+			}
+		}
+	}
+}
+
+// remove deletes the series of the label set immediately, reporting whether
+// it existed.
+func (e *seriesExpirer) remove(lvals []string) bool {
+	key := seriesKey(lvals)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	deleted := e.vec.DeleteLabelValues(lvals...)
+	delete(e.series, key)
+	for _, forget := range e.forget {
+		forget(key)
+	}
+	return deleted
+}
+
+// sweeper periodically expires stale series of the given expirers until stop
+// is closed.
+func sweeper(expirers []*seriesExpirer, stop <-chan struct{}) {
+	interval := expirers[0].ttl
+	for _, e := range expirers[1:] {
+		if e.ttl < interval {
+			interval = e.ttl
+		}
+	}
+	if interval /= 2; interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, e := range expirers {
+				e.expire(now)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
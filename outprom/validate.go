@@ -0,0 +1,50 @@
+package outprom
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ValidateConfig checks the config without side effects, returning every
+// problem found. Each metric is created against a throwaway registry, which
+// also compiles its patterns, filters and expressions.
+func ValidateConfig(conf Config) []error {
+	var errs []error
+	if err := conf.resolve(); err != nil {
+		errs = append(errs, err)
+	}
+	if conf.Path != "" && !strings.HasPrefix(conf.Path, "/") {
+		errs = append(errs, fmt.Errorf("Path must start with /: %s", conf.Path))
+	}
+	if _, err := parseCIDRs(conf.AllowCIDRs); err != nil {
+		errs = append(errs, err)
+	}
+	for _, l := range conf.listeners() {
+		if _, err := l.tlsConfig(); err != nil {
+			errs = append(errs, fmt.Errorf("listen %s: %v", l.Address, err))
+		}
+	}
+	metrics := conf.effectiveMetrics()
+	if err := checkNames(metrics); err != nil {
+		errs = append(errs, err)
+	}
+	if err := checkWorkerPolicies(conf.Workers, metrics); err != nil {
+		errs = append(errs, err)
+	}
+	keys := make([]string, 0, len(metrics))
+	for name := range metrics {
+		keys = append(keys, name)
+	}
+	sort.Strings(keys)
+	reg := prometheus.NewRegistry()
+	for _, name := range keys {
+		metric := metrics[name]
+		if _, err := metric.New(name, reg, nil); err != nil {
+			errs = append(errs, fmt.Errorf("metrics.%s: %v", name, err))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,141 @@
+package outprom
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseFormatted parses s per the value format into float64. Durations are
+// converted into seconds, byte sizes into bytes and times into unix seconds.
+// The format "time:<layout>" parses a time in the layout of the time package,
+// while "time" is for RFC 3339.
+func parseFormatted(format ValueFormat, s string) (float64, error) {
+	if strings.HasPrefix(string(format), "time") {
+		layout := time.RFC3339Nano
+		if f := string(format); f != "time" {
+			layout = f[len("time:"):]
+		}
+		t, err := time.Parse(layout, strings.TrimSpace(s))
+		if err != nil {
+			return 0, err
+		}
+		return unixSeconds(t), nil
+	}
+	switch format {
+	case "duration":
+		d, err := time.ParseDuration(strings.TrimSpace(s))
+		if err != nil {
+			return 0, err
+		}
+		return d.Seconds(), nil
+	case "bytes":
+		return parseBytes(s)
+	}
+	return 0, fmt.Errorf("Unknown value format: %s", format)
+}
+
+// unixSeconds returns t in unix seconds preserving sub-second precision.
+func unixSeconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / 1e9
+}
+
+// toFloat converts a value decoded from a record into float64. Numeric types
+// and strings parsable as a float are accepted, and booleans become 1 or 0.
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case bool:
+		if n {
+			return 1, true
+		}
+		return 0, true
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(n), 64)
+		return f, err == nil
+	case []byte:
+		f, err := strconv.ParseFloat(strings.TrimSpace(string(n)), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// toString converts a scalar value decoded from a record into a label value.
+// nil, which is the result of a missing field, becomes an empty string.
+func toString(v interface{}) (string, bool) {
+	switch s := v.(type) {
+	case nil:
+		return "", true
+	case string:
+		return s, true
+	case []byte:
+		return string(s), true
+	case bool:
+		return strconv.FormatBool(s), true
+	case float64:
+		return strconv.FormatFloat(s, 'f', -1, 64), true
+	case float32:
+		return strconv.FormatFloat(float64(s), 'f', -1, 32), true
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return fmt.Sprint(s), true
+	}
+	return "", false
+}
+
+var byteUnits = map[byte]float64{'k': 1, 'm': 2, 'g': 3, 't': 4, 'p': 5, 'e': 6}
+
+// parseBytes parses a byte size such as "512", "512k", "4.2MiB" or "1.5 GB".
+// A unit letter is case-insensitive and denotes a power of 1000 (SI), unless
+// it is followed by "i" which denotes a power of 1024 (IEC), so "k" and "KB"
+// are 1000 while "Ki" and "KiB" are 1024. A trailing "B" or "b" is optional
+// and always means bytes, not bits.
+func parseBytes(s string) (float64, error) {
+	t := strings.TrimSpace(s)
+	if strings.HasSuffix(t, "B") || strings.HasSuffix(t, "b") {
+		t = t[:len(t)-1]
+	}
+	base := 1000.0
+	if strings.HasSuffix(t, "i") {
+		base = 1024
+		t = t[:len(t)-1]
+	}
+	exp := 0.0
+	if n := len(t); n > 0 {
+		if e, ok := byteUnits[t[n-1]|0x20]; ok {
+			exp = e
+			t = t[:n-1]
+		} else if base == 1024 {
+			return 0, fmt.Errorf("invalid byte size: %q", s)
+		}
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(t), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid byte size: %q", s)
+	}
+	return v * math.Pow(base, exp), nil
+}
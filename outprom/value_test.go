@@ -0,0 +1,99 @@
+package outprom
+
+import (
+	"math"
+	"testing"
+)
+
+func TestToFloat(t *testing.T) {
+	tests := []struct {
+		v    interface{}
+		want float64
+		ok   bool
+	}{
+		{1.5, 1.5, true},
+		{float32(0.25), 0.25, true},
+		{int(-3), -3, true},
+		{int8(-8), -8, true},
+		{int64(1 << 40), 1 << 40, true},
+		{uint8(255), 255, true},
+		{uint32(1 << 31), 1 << 31, true},
+		{uint64(math.MaxUint64), math.MaxUint64, true},
+		{uint64(1 << 63), 1 << 63, true},
+		{true, 1, true},
+		{false, 0, true},
+		{"42", 42, true},
+		{" 4.2e1 ", 42, true},
+		{"-0.5", -0.5, true},
+		{[]byte("12"), 12, true},
+		{"12ms", 0, false},
+		{"", 0, false},
+		{nil, 0, false},
+		{map[string]interface{}{}, 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := toFloat(tt.v)
+		if ok != tt.ok || ok && got != tt.want {
+			t.Errorf("toFloat(%#v) = %v, %v, want %v, %v", tt.v, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// TestMsgpackIntegers checks that the integer types msgpack decodes to are
+// accepted as values, uint64 included.
+func TestMsgpackIntegers(t *testing.T) {
+	h, reg := newTestHandler(t, `
+type = "counter"
+value = "n"
+`)
+	for _, n := range []interface{}{uint64(1 << 32), int64(2), uint8(3), "4"} {
+		handle(t, h, newEvent("t", map[string]interface{}{"n": n}))
+	}
+	assertMetrics(t, reg, `test 4.294967305e+09`)
+}
+
+func TestNonFiniteAction(t *testing.T) {
+	sources := []struct {
+		name   string
+		conf   string
+		record map[string]interface{}
+		want   string // exposed value with non_finite_action = "pass"
+	}{
+		{"+Inf field", `value = "v"`, map[string]interface{}{"v": math.Inf(1)}, "+Inf"},
+		{"-Inf field", `value = "v"`, map[string]interface{}{"v": math.Inf(-1)}, "-Inf"},
+		{"NaN string", `value = "v"`, map[string]interface{}{"v": "NaN"}, "NaN"},
+		{"overflowing expression", `value_expr = "v * 10"`, map[string]interface{}{"v": 1e308}, "+Inf"},
+		{"NaN expression", `value_expr = "v - v"`, map[string]interface{}{"v": math.Inf(1)}, "NaN"},
+	}
+	for _, src := range sources {
+		for _, action := range []string{"", "skip", "zero", "error", "pass"} {
+			t.Run(src.name+"/"+action, func(t *testing.T) {
+				conf := "type = \"gauge\"\n" + src.conf + "\n"
+				if action != "" {
+					conf += "non_finite_action = \"" + action + "\"\n"
+				}
+				h, reg := newTestHandler(t, conf)
+				err := h.HandleEvent(newEvent("t", src.record))
+				want := ""
+				switch action {
+				case "", "skip":
+					if err != nil && err != errSkip {
+						t.Errorf("err = %v, want the sample skipped", err)
+					}
+				case "zero":
+					want = "test 0"
+				case "error":
+					if err == nil || errorKind(err) != errNonFinite {
+						t.Errorf("err = %v, want a non_finite error", err)
+					}
+				case "pass":
+					want = "test " + src.want
+				}
+				if want != "" && err != nil {
+					t.Fatal(err)
+				}
+				assertMetrics(t, reg, want, "test")
+			})
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package outprom
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Version and Revision are set at build time, e.g.
+//
+//	go build -ldflags "-X github.com/yosisa/fluxion-out-prometheus/outprom.Version=1.2.0 -X github.com/yosisa/fluxion-out-prometheus/outprom.Revision=$(git rev-parse --short HEAD)"
+var (
+	Version  = "dev"
+	Revision = "unknown"
+)
+
+// VersionString describes the build of the plugin.
+func VersionString() string {
+	return fmt.Sprintf("out-prometheus version %s (revision %s, %s)", Version, Revision, runtime.Version())
+}
@@ -0,0 +1,159 @@
+package outprom
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yosisa/fluxion/message"
+)
+
+const defaultQueueSize = 1024
+
+type QueueFullAction string
+
+func (a *QueueFullAction) UnmarshalText(b []byte) error {
+	s := string(b)
+	switch s {
+	case "block", "drop":
+		*a = QueueFullAction(s)
+		return nil
+	}
+	return fmt.Errorf("Unknown queue_full_action: %s", s)
+}
+
+// workerPool processes events on worker goroutines. A metric is always
+// processed by the same worker, so the events are applied to each metric in
+// the order received, which matters for gauges, while different metrics are
+// processed concurrently.
+type workerPool struct {
+	p      *OutPrometheus
+	queues []chan job
+	drop   bool
+	wg     sync.WaitGroup
+	// mu guards the queues against being closed while events are sent.
+	mu     sync.RWMutex
+	closed bool
+}
+
+type job struct {
+	h  Handler
+	ev *pendingEvent
+}
+
+// pendingEvent tracks an event dispatched to several workers.
+type pendingEvent struct {
+	x       jsonExpander
+	pending int32
+	failed  int32
+}
+
+func newWorkerPool(p *OutPrometheus, workers, size int, drop bool) *workerPool {
+	if size <= 0 {
+		size = defaultQueueSize
+	}
+	wp := &workerPool{p: p, queues: make([]chan job, workers), drop: drop}
+	for i := range wp.queues {
+		q := make(chan job, size)
+		wp.queues[i] = q
+		wp.wg.Add(1)
+		go func() {
+			defer wp.wg.Done()
+			for j := range q {
+				wp.run(j)
+			}
+		}()
+	}
+	return wp
+}
+
+// dispatch queues the event for the handlers. It blocks while the queue of a
+// handler is full unless queue_full_action is "drop".
+func (wp *workerPool) dispatch(ev *message.Event, handlers []Handler) {
+	if len(handlers) == 0 {
+		return
+	}
+	wp.mu.RLock()
+	defer wp.mu.RUnlock()
+	if wp.closed {
+		return
+	}
+	pe := &pendingEvent{x: jsonExpander{ev: event{Event: ev}, now: time.Now()}, pending: int32(len(handlers))}
+	if len(handlers) > 1 {
+		pe.x.ev.x = newExtraction(wp.p.stats.paths.len())
+	}
+	for _, h := range handlers {
+		q := wp.queues[wp.shard(h)]
+		j := job{h, pe}
+		if !wp.drop {
+			q <- j
+			continue
+		}
+		select {
+		case q <- j:
+		default:
+			wp.p.stats.queueDropped.WithLabelValues(h.metricName()).Inc()
+			atomic.StoreInt32(&pe.failed, 1)
+			wp.done(pe)
+		}
+	}
+}
+
+func (wp *workerPool) shard(h Handler) int {
+	f := fnv.New32a()
+	f.Write([]byte(h.metricName()))
+	return int(f.Sum32() % uint32(len(wp.queues)))
+}
+
+func (wp *workerPool) run(j job) {
+	if err := wp.p.process(j.h, &j.ev.x); err != nil {
+		atomic.StoreInt32(&j.ev.failed, 1)
+	}
+	wp.done(j.ev)
+}
+
+func (wp *workerPool) done(pe *pendingEvent) {
+	if atomic.AddInt32(&pe.pending, -1) != 0 {
+		return
+	}
+	if pe.x.ev.x != nil {
+		pe.x.ev.x.release()
+	}
+	if atomic.LoadInt32(&pe.failed) == 0 {
+		wp.p.processed(pe.x.now)
+	}
+}
+
+// close processes the queued events and stops the workers. Events dispatched
+// afterwards are ignored.
+func (wp *workerPool) close() {
+	wp.mu.Lock()
+	wp.closed = true
+	for _, q := range wp.queues {
+		close(q)
+	}
+	wp.mu.Unlock()
+	wp.wg.Wait()
+}
+
+// checkWorkerPolicies rejects on_error = "fail" with workers, as the handlers
+// run after Encode returned and their errors cannot fail the event.
+func checkWorkerPolicies(workers int, metrics map[string]Metric) error {
+	if workers <= 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(metrics))
+	for name := range metrics {
+		keys = append(keys, name)
+	}
+	sort.Strings(keys)
+	for _, name := range keys {
+		if metrics[name].OnError == "fail" {
+			return fmt.Errorf("metrics.%s: on_error = \"fail\" cannot be used with workers", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package outprom
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestWorkerPoolCloseWhileDispatching(t *testing.T) {
+	p := sharedLabelPlugin(t, 2)
+	wp := newWorkerPool(p, 2, 1, false)
+	handlers := p.loadHandlers()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 500; n++ {
+				wp.dispatch(sharedLabelEvent(), handlers)
+			}
+		}()
+	}
+	wp.close()
+	wg.Wait()
+	wp.dispatch(sharedLabelEvent(), handlers)
+}
+
+func TestCheckWorkerPolicies(t *testing.T) {
+	metrics := map[string]Metric{"a": {OnError: "log"}, "b": {OnError: "fail"}}
+	if err := checkWorkerPolicies(0, metrics); err != nil {
+		t.Errorf("without workers: %v", err)
+	}
+	if err := checkWorkerPolicies(2, metrics); err == nil {
+		t.Error("on_error = \"fail\" accepted with workers")
+	}
+}